@@ -0,0 +1,219 @@
+package guerrilla
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Envelope is a message accepted from a client, it is passed to a Backend for saving
+type Envelope struct {
+	RemoteAddress string            // ip address of the client
+	Helo          string            // what the client said in HELO / EHLO
+	MailFrom      string            // user@host, validated. Empty for the null sender <>
+	MailParams    map[string]string // ESMTP parameters of MAIL FROM, eg. SIZE, BODY, SMTPUTF8. Keys are upper case
+	RcptTo        []string          // each user@host, validated against the allowed hosts
+	Header        Header            // the header of the message
+	Subject       string            // the Subject header, not decoded yet. See Header.Subject
+	TLS           bool              // true if the message arrived over TLS
+	ServerName    string            // Host_name of the server that accepted the message
+	QueueID       string            // the id of the message, see IDGenerator
+	Hashes        []string          // the hash of each copy, one for each of RcptTo, see copyHashes
+	data          *spool            // the DATA, without any extra headers, see NewReader
+
+	// Set by the processors of a chain for the steps after them, see Processor
+	DeliveryHeader string                 `json:"-"` // headers to add before the DATA, eg. Received
+	Parsed         *ParsedMessage         `json:"-"` // the MIME structure, see the mime processor
+	Values         map[string]interface{} `json:"-"` // anything else, by the name of the value
+
+	// When the client stops waiting, Process should return by then. Zero if no client is
+	// waiting, eg. for a message from the queue
+	Deadline time.Time `json:"-"`
+}
+
+// NewReader returns a reader for the DATA, without any extra headers.
+// Each call starts again from the beginning, so a backend can read the message more than once.
+func (e *Envelope) NewReader() io.Reader {
+	return e.data.NewReader()
+}
+
+// Size is the length of the DATA in bytes
+func (e *Envelope) Size() int64 {
+	return e.data.Len()
+}
+
+// envelopeID is the id of the message, e.QueueID. An envelope that was not given one gets one.
+func envelopeID(e *Envelope) string {
+	if e.QueueID == "" {
+		e.QueueID = newID("", e.MailFrom, e.Subject)
+	}
+	return e.QueueID
+}
+
+// copyHashes sets e.Hashes, unless they were set by an earlier attempt to save the message.
+// The first copy is saved by the id of the message, so that the id in the "queued as" reply
+// and in the Received header is the key of a copy. The other copies get new ids.
+func copyHashes(e *Envelope, primaryHost string) error {
+	if len(e.Hashes) == len(e.RcptTo) {
+		return nil
+	}
+	hashes := make([]string, len(e.RcptTo))
+	for i, rcpt := range e.RcptTo {
+		to, _, err := primaryAddress(rcpt, primaryHost)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			hashes[i] = envelopeID(e)
+		} else {
+			hashes[i] = newID(to, e.MailFrom, e.Subject)
+		}
+	}
+	e.Hashes = hashes
+	return nil
+}
+
+// deadlineContext is a context that ends at e.Deadline, or never if no client is waiting
+func deadlineContext(e *Envelope) (context.Context, context.CancelFunc) {
+	if e.Deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), e.Deadline)
+}
+
+// dropSaved takes the first n recipients out of e when their copies were saved but a later
+// one failed, so that they don't get a second copy when the message is tried again from the queue.
+// Their hashes go too, the others are kept for the next attempt.
+func dropSaved(e *Envelope, n int) {
+	e.RcptTo = e.RcptTo[n:]
+	if len(e.Hashes) >= n {
+		e.Hashes = e.Hashes[n:]
+	}
+}
+
+// saveCopies saves a copy of e for each recipient with save, which is given the user and host
+// of the recipient, the address the copy is delivered to, see deliveredTo, and the hash of the copy.
+// If a copy can't be saved, the ones saved before it are dropped from e, see dropSaved.
+// The id of the message is returned.
+func saveCopies(e *Envelope, primaryHost string, save func(user, host, to, hash string) error) (string, error) {
+	if err := copyHashes(e, primaryHost); err != nil {
+		return "", err
+	}
+	for i, rcpt := range e.RcptTo {
+		user, host, err := extractEmail(rcpt)
+		if err == nil {
+			err = save(user, host, deliveredTo(user, host, primaryHost), e.Hashes[i])
+		}
+		if err != nil {
+			dropSaved(e, i)
+			return "", err
+		}
+	}
+	return envelopeID(e), nil
+}
+
+// deliveredTo is the address a copy for user@host is saved for, the user at primaryHost,
+// or user@host if primary_mail_host is not set. It is the Delivered-To header in every backend.
+func deliveredTo(user string, host string, primaryHost string) string {
+	if primaryHost == "" {
+		return user + "@" + host
+	}
+	return user + "@" + primaryHost
+}
+
+// deliveryHeaders are the Delivered-To and Received headers added to the copy of the message for to
+func deliveryHeaders(e *Envelope, to string) string {
+	return "Delivered-To: " + to + "\r\n" + receivedHeader(e)
+}
+
+// receivedHeader is the Received header for the message, with its queue id
+func receivedHeader(e *Envelope) string {
+	hash := envelopeID(e)
+	add_head := ""
+	add_head += "Received: from " + e.Helo + " (" + e.Helo + "  [" + e.RemoteAddress + "])\r\n"
+	add_head += "	by " + e.ServerName + " with SMTP id " + hash + "@" +
+		e.ServerName + ";\r\n"
+	add_head += "	" + time.Now().Format(time.RFC1123Z) + "\r\n"
+	return add_head
+}
+
+// SMTPError is an error from Process with the reply for the client.
+// Any other error is a temporary failure, replied with a 451.
+type SMTPError struct {
+	Code    int    // eg. 554
+	Message string // eg. "5.7.1 Rejected by policy"
+}
+
+func (e *SMTPError) Error() string {
+	return strconv.Itoa(e.Code) + " " + e.Message
+}
+
+// isPermanent tells if err is a 5xx SMTPError, the message should not be tried again
+func isPermanent(err error) bool {
+	smtpErr, ok := err.(*SMTPError)
+	return ok && smtpErr.Code >= 500
+}
+
+// Backend saves the mail.
+// Process is called by several save workers at the same time, so it must be safe for concurrent use.
+type Backend interface {
+	// Initialize is called once, before the first call to Process
+	Initialize(config GlobalConfig) error
+	// Process saves the envelope and returns the id for the "queued as" reply.
+	// If e.Deadline is set, the client is waiting and Process should return by then.
+	Process(e *Envelope) (queueID string, err error)
+	// Shutdown releases any resources once the workers stopped calling Process
+	Shutdown() error
+}
+
+// The backend used when backend_name is not set
+const DefaultBackendName = "guerrilla-db-redis"
+
+var backendsMu sync.Mutex
+var backends = make(map[string]func() Backend)
+
+// RegisterBackend makes a backend available by name for the backend_name config setting.
+// Call it from the init function of the package with the backend, so that it is known
+// before NewBackend. A name that is already taken panics.
+func RegisterBackend(name string, factory func() Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if _, dup := backends[name]; dup {
+		panic("guerrilla: RegisterBackend called twice for " + name)
+	}
+	backends[name] = factory
+}
+
+// NewBackend creates the backend named by config.Backend_name and initializes it.
+// If config.Save_process is set, the backend is the chain of processors it names instead.
+func NewBackend(config GlobalConfig) (Backend, error) {
+	if config.Save_process != "" {
+		c := newChain(config.Save_process)
+		if err := c.Initialize(config); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	name := config.Backend_name
+	if name == "" {
+		name = DefaultBackendName
+	}
+	return newBackend(name, config)
+}
+
+func newBackend(name string, config GlobalConfig) (Backend, error) {
+	backendsMu.Lock()
+	factory, ok := backends[name]
+	backendsMu.Unlock()
+	if !ok {
+		return nil, errors.New("Unknown backend: " + name)
+	}
+	b := factory()
+	if err := b.Initialize(config); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,265 @@
+package guerrilla
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The bolt backend saves the mail in an embedded key-value store, a single file
+// needing no other services. The same fields as the guerrilla-db-redis backend are
+// saved for each copy of a message, with the compressed message. Copies expire after
+// bolt_expire_seconds, or redis_expire_seconds if that is not set. -1 keeps them.
+// The backend is a MessageStore, so that the mail can be read back.
+func init() {
+	RegisterBackend("bolt", func() Backend {
+		return &boltBackend{}
+	})
+}
+
+// MessageStore is a Backend that can read back the mail it saved
+type MessageStore interface {
+	// List returns the copies saved for recipient, newest first
+	List(recipient string) ([]StoredMessage, error)
+	// Fetch returns a copy and its message, with the Delivered-To and Received headers
+	Fetch(hash string) (StoredMessage, []byte, error)
+}
+
+// StoredMessage is a saved copy of a message
+type StoredMessage struct {
+	Hash       string
+	Date       time.Time
+	Expires    time.Time // zero if it does not expire
+	To         string    // the recipient at primary_mail_host
+	Recipient  string    // the recipient as given in RCPT TO
+	From       string
+	ReturnPath string
+	Subject    string // decoded
+	IpAddr     string
+	IsTLS      bool
+}
+
+// ErrNotFound is returned by MessageStore.Fetch when there is no such message, or it expired
+var ErrNotFound = errors.New("Message not found")
+
+// Buckets:
+//
+//	meta:       hash -> StoredMessage as JSON
+//	mail:       hash -> compressed message
+//	recipients: one bucket for each recipient, date + hash -> nothing
+//	expiry:     expiry time + hash -> nothing
+var (
+	boltMeta       = []byte("meta")
+	boltMail       = []byte("mail")
+	boltRecipients = []byte("recipients")
+	boltExpiry     = []byte("expiry")
+)
+
+type boltBackend struct {
+	config GlobalConfig
+	db     *bolt.DB
+	ttl    time.Duration // 0 to keep the mail forever
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+func (b *boltBackend) Initialize(config GlobalConfig) error {
+	if config.Bolt_file == "" {
+		return errors.New("bolt_file is not set")
+	}
+	db, err := bolt.Open(config.Bolt_file, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return errors.New("Cannot open bolt_file: " + err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltMeta, boltMail, boltRecipients, boltExpiry} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	b.config = config
+	b.db = db
+	expire := config.Bolt_expire_seconds
+	if expire == 0 {
+		expire = config.Redis_expire_seconds
+	}
+	if expire > 0 {
+		b.ttl = time.Duration(expire) * time.Second
+	}
+	b.quit = make(chan struct{})
+	b.done = make(chan struct{})
+	go b.expireLoop()
+	return nil
+}
+
+// Process saves one copy of the message for each recipient, the hash of the first copy is returned
+func (b *boltBackend) Process(e *Envelope) (string, error) {
+	subject := mimeHeaderDecode(e.Subject)
+	return saveCopies(e, b.config.Primary_host, func(user, host, to, hash string) error {
+		now := time.Now()
+		m := StoredMessage{
+			Hash:       hash,
+			Date:       now,
+			To:         to,
+			Recipient:  user + "@" + host,
+			From:       e.MailFrom,
+			ReturnPath: e.MailFrom,
+			Subject:    subject,
+			IpAddr:     e.RemoteAddress,
+			IsTLS:      e.TLS,
+		}
+		if b.ttl > 0 {
+			m.Expires = now.Add(b.ttl)
+		}
+		data, err := compress(strings.NewReader(deliveryHeaders(e, m.To)), e.NewReader())
+		if err != nil {
+			return err
+		}
+		return b.save(&m, []byte(data))
+	})
+}
+
+func (b *boltBackend) save(m *StoredMessage, data []byte) error {
+	meta, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltMeta).Put([]byte(m.Hash), meta); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltMail).Put([]byte(m.Hash), data); err != nil {
+			return err
+		}
+		rcpt, err := tx.Bucket(boltRecipients).CreateBucketIfNotExists([]byte(strings.ToLower(m.Recipient)))
+		if err != nil {
+			return err
+		}
+		if err := rcpt.Put(boltTimeKey(m.Date, m.Hash), nil); err != nil {
+			return err
+		}
+		if m.Expires.IsZero() {
+			return nil
+		}
+		return tx.Bucket(boltExpiry).Put(boltTimeKey(m.Expires, m.Hash), nil)
+	})
+}
+
+// boltTimeKey sorts by time, then by hash
+func boltTimeKey(t time.Time, hash string) []byte {
+	key := make([]byte, 8, 8+len(hash))
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return append(key, hash...)
+}
+
+// List returns the copies saved for recipient, newest first
+func (b *boltBackend) List(recipient string) ([]StoredMessage, error) {
+	var list []StoredMessage
+	now := time.Now()
+	err := b.db.View(func(tx *bolt.Tx) error {
+		rcpt := tx.Bucket(boltRecipients).Bucket([]byte(strings.ToLower(recipient)))
+		if rcpt == nil {
+			return nil
+		}
+		meta := tx.Bucket(boltMeta)
+		c := rcpt.Cursor()
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			var m StoredMessage
+			if err := json.Unmarshal(meta.Get(k[8:]), &m); err != nil {
+				return err
+			}
+			if m.Expires.IsZero() || m.Expires.After(now) {
+				list = append(list, m)
+			}
+		}
+		return nil
+	})
+	return list, err
+}
+
+// Fetch returns a copy and its message, with the Delivered-To and Received headers
+func (b *boltBackend) Fetch(hash string) (m StoredMessage, data []byte, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltMeta).Get([]byte(hash))
+		if meta == nil {
+			return ErrNotFound
+		}
+		if err := json.Unmarshal(meta, &m); err != nil {
+			return err
+		}
+		if !m.Expires.IsZero() && !m.Expires.After(time.Now()) {
+			return ErrNotFound
+		}
+		// the value is only valid in the transaction
+		r, err := zlib.NewReader(bytes.NewReader(tx.Bucket(boltMail).Get([]byte(hash))))
+		if err != nil {
+			return err
+		}
+		data, err = ioutil.ReadAll(r)
+		return err
+	})
+	return m, data, err
+}
+
+// expireLoop deletes the expired copies every minute, until Shutdown
+func (b *boltBackend) expireLoop() {
+	defer close(b.done)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		if err := b.expire(time.Now()); err != nil {
+			log.Printf("bolt: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// expire deletes the copies that expired before now
+func (b *boltBackend) expire(now time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		expiry := tx.Bucket(boltExpiry)
+		meta := tx.Bucket(boltMeta)
+		recipients := tx.Bucket(boltRecipients)
+		end := boltTimeKey(now, "")
+		c := expiry.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.First() {
+			hash := append([]byte(nil), k[8:]...)
+			var m StoredMessage
+			if err := json.Unmarshal(meta.Get(hash), &m); err == nil {
+				if rcpt := recipients.Bucket([]byte(strings.ToLower(m.Recipient))); rcpt != nil {
+					rcpt.Delete(boltTimeKey(m.Date, m.Hash))
+				}
+			}
+			meta.Delete(hash)
+			tx.Bucket(boltMail).Delete(hash)
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltBackend) Shutdown() error {
+	close(b.quit)
+	<-b.done
+	return b.db.Close()
+}
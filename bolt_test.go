@@ -0,0 +1,96 @@
+package guerrilla
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// openTestBolt opens a bolt backend in a temporary directory, closed when the test ends
+func openTestBolt(t *testing.T, expire int) *boltBackend {
+	dir, err := ioutil.TempDir("", "bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &boltBackend{}
+	if err := b.Initialize(GlobalConfig{Bolt_file: filepath.Join(dir, "mail.db"), Bolt_expire_seconds: expire}); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		b.Shutdown()
+		os.RemoveAll(dir)
+	})
+	return b
+}
+
+func TestBoltQueuedAs(t *testing.T) {
+	b := openTestBolt(t, -1)
+	e := newTestEnvelope("Subject: hi\r\n\r\nhello\r\n", "alice@example.com", "bob@example.com")
+	id, err := b.Process(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the id the client is given is the key of the first copy
+	m, data, err := b.Fetch(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Recipient != "alice@example.com" || !m.Expires.IsZero() {
+		t.Errorf("fetched %+v", m)
+	}
+	if message := string(data); !strings.HasPrefix(message, "Delivered-To: alice@example.com\r\nReceived: ") ||
+		!strings.HasSuffix(message, "\r\nSubject: hi\r\n\r\nhello\r\n") {
+		t.Errorf("fetched %q", message)
+	}
+	list, err := b.List("Bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Hash == id || list[0].To != "bob@example.com" {
+		t.Errorf("listed %+v", list)
+	}
+}
+
+func TestBoltExpire(t *testing.T) {
+	b := openTestBolt(t, 60)
+	id, err := b.Process(newTestEnvelope("Subject: hi\r\n\r\nhello\r\n", "alice@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := b.Fetch(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(m.Expires); until < 50*time.Second || until > time.Minute {
+		t.Errorf("expires in %v", until)
+	}
+	if err := b.expire(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.Fetch(id); err != nil {
+		t.Fatalf("expired early: %v", err)
+	}
+	if err := b.expire(m.Expires.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := b.List("alice@example.com"); err != nil || len(list) != 0 {
+		t.Errorf("listed %v, %v", list, err)
+	}
+	b.db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltMeta, boltMail} {
+			if tx.Bucket(name).Get([]byte(id)) != nil {
+				t.Errorf("%s of the expired copy is still there", name)
+			}
+		}
+		if tx.Bucket(boltExpiry).Stats().KeyN != 0 {
+			t.Error("the expiry key is still there")
+		}
+		return nil
+	})
+}
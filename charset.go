@@ -0,0 +1,211 @@
+package guerrilla
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// The charsets are decoded to UTF-8 in Go, looked up by name in the registered charsets,
+// then in the WHATWG (https://encoding.spec.whatwg.org/) and IANA names and aliases.
+// The registered charsets are the names seen in mail that are not there,
+// or are there for another charset.
+var charsetsMu sync.RWMutex
+var charsets = map[string]encoding.Encoding{
+	"cp949":          korean.EUCKR, // decoded as the Windows superset of EUC-KR
+	"ks_c_5601_1987": korean.EUCKR,
+	"x-windows-949":  korean.EUCKR,
+	"cp932":          japanese.ShiftJIS,
+	"cp936":          simplifiedchinese.GBK,
+	"cp950":          traditionalchinese.Big5,
+	"big5-hkscs":     traditionalchinese.Big5,
+}
+
+// RegisterCharset makes the charset name, case insensitive, decoded with e.
+// A name that is already known is replaced.
+func RegisterCharset(name string, e encoding.Encoding) {
+	charsetsMu.Lock()
+	defer charsetsMu.Unlock()
+	charsets[strings.ToLower(name)] = e
+}
+
+// charsetEncoding returns the encoding of the charset name, nil if it is not known
+func charsetEncoding(name string) encoding.Encoding {
+	name = strings.ToLower(strings.TrimSpace(name))
+	charsetsMu.RLock()
+	e, ok := charsets[name]
+	charsetsMu.RUnlock()
+	if ok {
+		return e
+	}
+	if e, err := htmlindex.Get(name); err == nil {
+		return e
+	}
+	// eg. "windows_1252". The cp125x names are WHATWG labels, the IBM code pages IANA aliases
+	name = strings.NewReplacer("_", "-", ":", "-", ".", "-", "/", "-").Replace(name)
+	if e, err := htmlindex.Get(name); err == nil {
+		return e
+	}
+	if e, err := ianaindex.MIME.Encoding(name); err == nil {
+		return e
+	}
+	return nil
+}
+
+var errUnknownCharset = errors.New("Unknown charset")
+
+// charsetReader decodes input from charset to UTF-8
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8", "us-ascii", "ascii", "":
+		return input, nil
+	}
+	e := charsetEncoding(charset)
+	if e == nil {
+		return nil, errUnknownCharset
+	}
+	return e.NewDecoder().Reader(input), nil
+}
+
+// decodeCharset decodes s from charset to UTF-8, s is returned as it is if charset is not known
+func decodeCharset(s string, charset string) string {
+	r, err := charsetReader(charset, strings.NewReader(s))
+	if err != nil {
+		return s
+	}
+	var b strings.Builder
+	if _, err := io.Copy(&b, r); err != nil {
+		return s
+	}
+	return b.String()
+}
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// mimeHeaderDecode decodes the encoded words of a header, RFC 2047.
+// eg. =?ISO-2022-JP?B?GyRCIVo9dztSOWJAOCVBJWMbKEI=?=
+// The white space between two encoded words is dropped. If a charset is not known,
+// str is returned as it is.
+func mimeHeaderDecode(str string) string {
+	decoded, err := wordDecoder.DecodeHeader(str)
+	if err != nil {
+		return str
+	}
+	return decoded
+}
+
+// parseMediaType parses a Content-Type or Content-Disposition value like mime.ParseMediaType,
+// but also decodes the parameters in charsets other than UTF-8 (RFC 2231),
+// eg. filename*=iso-8859-1”%E9t%E9.pdf, and encoded words in the names of files (RFC 2047).
+func parseMediaType(v string) (string, map[string]string, error) {
+	mediaType, params, err := mime.ParseMediaType(v)
+	if err != nil {
+		return mediaType, params, err
+	}
+	// mime.ParseMediaType drops the extended parameters in the other charsets,
+	// or leaves them in the charset when they are continued
+	type piece struct {
+		value   string
+		encoded bool // percent-encoded, name*n*=
+	}
+	extended := make(map[string]map[int]piece) // the pieces of each, by number
+	for _, param := range splitParams(v) {
+		i := strings.IndexByte(param, '=')
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(param[:i]))
+		star := strings.IndexByte(key, '*')
+		if star < 0 {
+			continue
+		}
+		name := key[:star]
+		n := 0
+		if number := strings.Trim(key[star:], "*"); number != "" {
+			if n, err = strconv.Atoi(number); err != nil {
+				continue
+			}
+		}
+		if extended[name] == nil {
+			extended[name] = make(map[int]piece)
+		}
+		extended[name][n] = piece{
+			value:   strings.Trim(strings.TrimSpace(param[i+1:]), `"`),
+			encoded: strings.HasSuffix(key, "*"),
+		}
+	}
+	for name, pieces := range extended {
+		// charset'language'value, the charset is on the first piece
+		parts := strings.SplitN(pieces[0].value, "'", 3)
+		if !pieces[0].encoded || len(parts) != 3 {
+			continue
+		}
+		switch strings.ToLower(parts[0]) {
+		case "utf-8", "us-ascii", "":
+			// decoded by mime.ParseMediaType
+			continue
+		}
+		value, err := url.PathUnescape(parts[2])
+		if err != nil {
+			continue
+		}
+		for n := 1; ; n++ {
+			p, ok := pieces[n]
+			if !ok {
+				break
+			}
+			if p.encoded {
+				if p.value, err = url.PathUnescape(p.value); err != nil {
+					break
+				}
+			}
+			value += p.value
+		}
+		if err == nil {
+			params[name] = decodeCharset(value, parts[0])
+		}
+	}
+	// not standard, but the names of files are often sent like that
+	for _, name := range []string{"name", "filename"} {
+		if value, ok := params[name]; ok {
+			params[name] = mimeHeaderDecode(value)
+		}
+	}
+	return mediaType, params, nil
+}
+
+// splitParams splits the parameters of a media type at the semicolons that are not quoted
+func splitParams(v string) []string {
+	var params []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				params = append(params, v[start:i])
+				start = i + 1
+			}
+		}
+	}
+	// the first is the media type
+	return append(params, v[start:])[1:]
+}
@@ -0,0 +1,117 @@
+package guerrilla
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func TestCharsetEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		want encoding.Encoding
+	}{
+		{"cp1252", charmap.Windows1252},
+		{"Windows_1252", charmap.Windows1252},
+		{"windows-1250", charmap.Windows1250},
+		{"ibm852", charmap.CodePage852},
+		{"cp852", charmap.CodePage852},
+		{"IBM-1047", charmap.CodePage1047},
+		{"ibm866", charmap.CodePage866},
+		{" KS_C_5601-1987 ", korean.EUCKR},
+		{"cp949", korean.EUCKR},
+		{"GB18030", simplifiedchinese.GB18030},
+		{"iso-2022-jp", japanese.ISO2022JP},
+		{"x-unknown", nil},
+		{"cp", nil},
+	}
+	for _, test := range tests {
+		if got := charsetEncoding(test.name); got != test.want {
+			t.Errorf("%q: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMimeHeaderDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		want    string
+	}{
+		{"not encoded", "hello there", "hello there"},
+		{"ISO-2022-JP", "=?ISO-2022-JP?B?GyRCRnxLXDhsJE4lYSE8JWsbKEI=?=", "日本語のメール"},
+		{"GB18030", "=?GB18030?B?1tDOxNPKvP4=?=", "中文邮件"},
+		{"Windows-1252", "=?windows-1252?Q?caf=E9_=805?=", "café €5"},
+		{"IBM852", "=?ibm852?Q?=88=A2d=AB?=", "łódź"},
+		{"adjacent words", "=?UTF-8?Q?h=C3=A9?= \r\n =?UTF-8?Q?_l=C3=A0?=", "hé là"},
+		{"words and text", "=?UTF-8?Q?h=C3=A9?= and =?UTF-8?Q?l=C3=A0?=", "hé and là"},
+		{"mixed charsets", "=?ISO-8859-1?Q?caf=E9?= =?GB18030?B?1tDOxA==?=", "café中文"},
+		{"bad charset", "=?x-unknown?Q?caf=E9?=", "=?x-unknown?Q?caf=E9?="},
+	}
+	for _, test := range tests {
+		if got := mimeHeaderDecode(test.encoded); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseMediaType(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		mediaType string
+		params    map[string]string
+	}{
+		{
+			name:      "plain",
+			value:     `text/plain; charset="utf-8"; format=flowed`,
+			mediaType: "text/plain",
+			params:    map[string]string{"charset": "utf-8", "format": "flowed"},
+		},
+		{
+			name:      "RFC 2231 with a charset",
+			value:     `attachment; filename*=iso-8859-1'fr'%E9t%E9.pdf`,
+			mediaType: "attachment",
+			params:    map[string]string{"filename": "été.pdf"},
+		},
+		{
+			name:      "RFC 2231 continuations with a charset",
+			value:     "attachment; filename*0*=windows-1252''caf%E9; filename*1=\"-menu\"; filename*2*=%80.pdf",
+			mediaType: "attachment",
+			params:    map[string]string{"filename": "café-menu€.pdf"},
+		},
+		{
+			name:      "RFC 2231 continuations in UTF-8",
+			value:     `attachment; filename*0*=UTF-8''%C3%A9t; filename*1*=%C3%A9.pdf`,
+			mediaType: "attachment",
+			params:    map[string]string{"filename": "été.pdf"},
+		},
+		{
+			name:      "encoded word name",
+			value:     `application/pdf; name="=?GB18030?B?1tDOxA==?=.pdf"`,
+			mediaType: "application/pdf",
+			params:    map[string]string{"name": "中文.pdf"},
+		},
+		{
+			name:      "quoted semicolon",
+			value:     `attachment; filename="a;b.txt"; size=5`,
+			mediaType: "attachment",
+			params:    map[string]string{"filename": "a;b.txt", "size": "5"},
+		},
+	}
+	for _, test := range tests {
+		mediaType, params, err := parseMediaType(test.value)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if mediaType != test.mediaType || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("%s: got %s %q, want %s %q", test.name, mediaType, params, test.mediaType, test.params)
+		}
+	}
+}
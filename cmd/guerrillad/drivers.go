@@ -0,0 +1,7 @@
+package main
+
+// The database drivers for the sql_driver setting
+import (
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
@@ -0,0 +1,229 @@
+/**
+Go-Guerrilla SMTPd
+
+Version: 1.5
+Author: Flashmob, GuerrillaMail.com
+Contact: flashmob@gmail.com
+License: MIT
+Repository: https://github.com/flashmob/Go-Guerrilla-SMTPd
+Site: http://www.guerrillamail.com/
+
+See README for more details
+
+
+*/
+
+// guerrillad runs the servers listed in the configuration file using the guerrilla package.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/remohammadi/go-guerrilla"
+)
+
+var mainConfig guerrilla.GlobalConfig
+var flagVerbose, flagIface, flagConfigFile string
+
+var backend guerrilla.Backend
+var saveWorkers *guerrilla.SaveWorkers
+var servers = make(map[string]*guerrilla.Server) // running servers by listen interface
+var stopping sync.WaitGroup                      // servers disabled by a reload, still finishing
+var pidFile string
+
+var signalChannel = make(chan os.Signal, 1) // for trapping SIG_HUB, SIGTERM and SIGINT
+
+func sigHandler() {
+	for sig := range signalChannel {
+		if sig == syscall.SIGHUP {
+			if err := readConfig(); err != nil {
+				fmt.Printf("Not reloading, %v\n", err)
+				continue
+			}
+			reload()
+			fmt.Print("Reloading Configuration!\n")
+		} else {
+			shutdown()
+			os.Exit(0)
+		}
+
+	}
+}
+
+// reload applies mainConfig to the running servers and save workers.
+// Newly enabled servers are started, disabled servers are shut down and
+// the others are reloaded, all without dropping the connected clients.
+func reload() {
+	enabled := make(map[string]bool)
+	for _, sConfig := range mainConfig.Servers {
+		if !sConfig.Is_enabled {
+			continue
+		}
+		enabled[sConfig.Listen_interface] = true
+		if server, ok := servers[sConfig.Listen_interface]; ok {
+			if err := server.Reload(sConfig); err != nil {
+				fmt.Printf("Reload of %s: %v\n", sConfig.Listen_interface, err)
+			}
+		} else if err := startServer(sConfig); err != nil {
+			fmt.Println(err)
+		}
+	}
+	for iface, server := range servers {
+		if enabled[iface] {
+			continue
+		}
+		delete(servers, iface)
+		stopping.Add(1)
+		go func(server *guerrilla.Server) {
+			defer stopping.Done()
+			ctx, cancel := context.WithTimeout(
+				context.Background(),
+				time.Duration(mainConfig.Shutdown_grace)*time.Second)
+			defer cancel()
+			server.Shutdown(ctx)
+		}(server)
+	}
+	saveWorkers.Resize(mainConfig.Save_workers_size)
+}
+
+// shutdown lets the clients finish within the grace period, saves the queued mail, then cleans up
+func shutdown() {
+	fmt.Print("Shutting down!\n")
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		time.Duration(mainConfig.Shutdown_grace)*time.Second)
+	defer cancel()
+	// all the servers stop accepting at once, then drain together within the grace period
+	var wg sync.WaitGroup
+	for iface, server := range servers {
+		wg.Add(1)
+		go func(iface string, server *guerrilla.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				fmt.Printf("Shutdown of %s: %v\n", iface, err)
+			}
+		}(iface, server)
+	}
+	wg.Wait()
+	stopping.Wait()
+	saveWorkers.Stop()
+	if err := backend.Shutdown(); err != nil {
+		fmt.Println(err)
+	}
+	os.Remove(pidFile)
+}
+
+// config is read at startup, or when a SIG_HUP is caught
+func readConfig() error {
+	log.SetOutput(os.Stdout)
+	// parse command line arguments
+	if !flag.Parsed() {
+		flag.StringVar(&flagConfigFile, "config", "goguerrilla.conf", "Path to the configuration file")
+		flag.StringVar(&flagVerbose, "v", "n", "Verbose, [y | n] ")
+		flag.StringVar(&flagIface, "if", "", "Interface and port to listen on, eg. 127.0.0.1:2525 ")
+		flag.Parse()
+	}
+	config, err := guerrilla.ReadConfig(flagConfigFile)
+	if err != nil {
+		return err
+	}
+
+	// copy command line flag over so it takes precedence
+	if len(flagVerbose) > 0 && strings.ToUpper(flagVerbose) == "Y" {
+		config.Verbose = true
+		for i := range config.Servers {
+			config.Servers[i].Verbose = true
+		}
+	}
+
+	if len(flagIface) > 0 && len(config.Servers) > 0 {
+		config.Servers[0].Listen_interface = flagIface
+	}
+	mainConfig = config
+	return nil
+}
+
+func initialise() {
+
+	// write out our PID
+	pidFile = mainConfig.Pid_file
+	if f, err := os.Create(pidFile); err == nil {
+		defer f.Close()
+		if _, err := f.WriteString(strconv.Itoa(os.Getpid())); err == nil {
+			f.Sync()
+		}
+	}
+	// handle SIGHUP for reloading the configuration while running,
+	// SIGTERM and SIGINT for shutting down gracefully
+	signal.Notify(signalChannel, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+
+	return
+}
+
+// startServer listens on sConfig.Listen_interface in the background
+func startServer(sConfig guerrilla.ServerConfig) error {
+	server, err := guerrilla.NewServer(sConfig, saveWorkers)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", sConfig.Listen_interface)
+	if err != nil {
+		return fmt.Errorf("Cannot listen on port, %v", err)
+	}
+	servers[sConfig.Listen_interface] = server
+	go server.Serve(listener)
+	return nil
+}
+
+func main() {
+	if err := readConfig(); err != nil {
+		fmt.Println(err)
+		log.Fatalln(err)
+	}
+	initialise()
+	if err := guerrilla.SetIDGenerator(mainConfig.Queue_id_generator, mainConfig.Node_id); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var err error
+	backend, err = guerrilla.NewBackend(mainConfig)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// start some savemail workers
+	saveWorkers = guerrilla.NewSaveWorkers(backend, mainConfig.Save_workers_size)
+	saveWorkers.SetBreaker(
+		mainConfig.Breaker_failures,
+		time.Duration(mainConfig.Breaker_cooldown)*time.Second)
+	saveWorkers.SetSaveTimeout(time.Duration(mainConfig.Save_timeout) * time.Second)
+	if mainConfig.Queue_dir != "" {
+		if err := saveWorkers.OpenQueue(
+			mainConfig.Queue_dir,
+			mainConfig.Dead_letter_dir,
+			mainConfig.RetryPolicy("queue")); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	// run our servers
+	for serverId := 0; serverId < len(mainConfig.Servers); serverId++ {
+		if mainConfig.Servers[serverId].Is_enabled {
+			if err := startServer(mainConfig.Servers[serverId]); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+	sigHandler()
+}
@@ -0,0 +1,9 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// SQLite needs cgo, so it is only built in with: go build -tags sqlite
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
@@ -1,29 +1,74 @@
-package main
+package guerrilla
 
 import (
 	"encoding/json"
-	"flag"
-	"fmt"
+	"errors"
 	"io/ioutil"
-	"log"
-	"os"
-	"strings"
 )
 
 type GlobalConfig struct {
-	Allowed_hosts        string         `json:"allowed_hosts"`
-	Primary_host         string         `json:"primary_mail_host"`
-	Verbose              bool           `json:"verbose"`
-	Mysql_table          string         `json:"mail_table"`
-	Mysql_db             string         `json:"mysql_db"`
-	Mysql_host           string         `json:"mysql_host"`
-	Mysql_pass           string         `json:"mysql_pass"`
-	Mysql_user           string         `json:"mysql_user"`
-	Servers              []ServerConfig `json:"servers"`
-	Pid_file             string         `json:"pid_file,omitempty"`
-	Save_workers_size    int            `json:"save_workers_size"`
-	Redis_expire_seconds int            `json:"redis_expire_seconds"`
-	Redis_interface      string         `json:"redis_interface"`
+	Allowed_hosts         string                 `json:"allowed_hosts"`
+	Primary_host          string                 `json:"primary_mail_host"`
+	Verbose               bool                   `json:"verbose"`
+	Mysql_table           string                 `json:"mail_table"`
+	Mysql_db              string                 `json:"mysql_db"`
+	Mysql_host            string                 `json:"mysql_host"`
+	Mysql_pass            string                 `json:"mysql_pass"`
+	Mysql_user            string                 `json:"mysql_user"`
+	Servers               []ServerConfig         `json:"servers"`
+	Pid_file              string                 `json:"pid_file,omitempty"`
+	Save_workers_size     int                    `json:"save_workers_size"`
+	Redis_expire_seconds  int                    `json:"redis_expire_seconds"`
+	Redis_interface       string                 `json:"redis_interface"`
+	Sql_driver            string                 `json:"sql_driver,omitempty"`            // mysql by default, or postgres, sqlite3
+	Sql_dsn               string                 `json:"sql_dsn,omitempty"`               // data source name for the driver, made from the mysql_ settings by default
+	Sql_insert            string                 `json:"sql_insert,omitempty"`            // statement saving a copy of the message, for the GuerrillaMail schema by default
+	Sql_counter           string                 `json:"sql_counter,omitempty"`           // optional statement run after each saved copy
+	Sql_max_open_conns    int                    `json:"sql_max_open_conns,omitempty"`    // save_workers_size by default
+	Sql_max_idle_conns    int                    `json:"sql_max_idle_conns,omitempty"`    // save_workers_size by default
+	Sql_conn_max_lifetime int                    `json:"sql_conn_max_lifetime,omitempty"` // seconds, connections are reused forever by default
+	Redis_password        string                 `json:"redis_password,omitempty"`
+	Redis_db              int                    `json:"redis_db,omitempty"`           // database index, 0 by default
+	Redis_max_idle        int                    `json:"redis_max_idle,omitempty"`     // idle connections kept in the pool, save_workers_size by default
+	Redis_max_active      int                    `json:"redis_max_active,omitempty"`   // most connections open at once, save_workers_size by default
+	Redis_idle_timeout    int                    `json:"redis_idle_timeout,omitempty"` // seconds before an idle connection is closed, 240 by default
+	Backend_name          string                 `json:"backend_name,omitempty"`
+	Save_process          string                 `json:"save_process,omitempty"`          // processors saving the mail, eg. "headers|hash|compress|redis|sql", instead of backend_name
+	Maildir_root          string                 `json:"maildir_root,omitempty"`          // for the maildir backend
+	Maildir_layout        string                 `json:"maildir_layout,omitempty"`        // path of each Maildir under maildir_root, "{domain}/{user}" by default
+	Mbox_file             string                 `json:"mbox_file,omitempty"`             // for the mbox backend
+	Eml_dir               string                 `json:"eml_dir,omitempty"`               // for the eml backend
+	Rotate_size           int                    `json:"rotate_size,omitempty"`           // bytes, for the mbox and eml backends. 0 to not rotate by size
+	Rotate_every          string                 `json:"rotate_every,omitempty"`          // hour, day or month, for the mbox and eml backends. Empty to not rotate by date
+	Bolt_file             string                 `json:"bolt_file,omitempty"`             // for the bolt backend
+	Bolt_expire_seconds   int                    `json:"bolt_expire_seconds,omitempty"`   // for the bolt backend, redis_expire_seconds by default. -1 to keep the mail
+	Webhook_url           string                 `json:"webhook_url,omitempty"`           // for the webhook backend
+	Webhook_secret        string                 `json:"webhook_secret,omitempty"`        // for the webhook backend, signs the requests when set
+	Webhook_timeout       int                    `json:"webhook_timeout,omitempty"`       // for the webhook backend, seconds for each request, 30 by default
+	Relay_addr            string                 `json:"relay_addr,omitempty"`            // for the relay backend, host:port or the path of a unix socket
+	Relay_protocol        string                 `json:"relay_protocol,omitempty"`        // for the relay backend, smtp or lmtp, smtp by default
+	Relay_tls             string                 `json:"relay_tls,omitempty"`             // for the relay backend, opportunistic, required, implicit or none, opportunistic by default
+	Relay_tls_skip_verify bool                   `json:"relay_tls_skip_verify,omitempty"` // for the relay backend, do not verify the certificate of the next hop
+	Relay_username        string                 `json:"relay_username,omitempty"`        // for the relay backend, AUTH PLAIN when set
+	Relay_password        string                 `json:"relay_password,omitempty"`        // for the relay backend
+	Relay_helo            string                 `json:"relay_helo,omitempty"`            // for the relay backend, the name given in EHLO / LHLO, the hostname by default
+	Relay_timeout         int                    `json:"relay_timeout,omitempty"`         // for the relay backend, seconds for each reply, 60 by default
+	Queue_id_generator    string                 `json:"queue_id_generator,omitempty"`    // ulid, random or md5, ulid by default
+	Node_id               string                 `json:"node_id,omitempty"`               // in the queue ids, unique for each server saving to the same place, up to 5 characters or it is hashed. The first part of the hostname by default
+	Shutdown_grace        int                    `json:"shutdown_grace,omitempty"`        // seconds to let clients finish on SIGTERM / SIGINT
+	Queue_dir             string                 `json:"queue_dir,omitempty"`             // optional durable queue in front of the backend
+	Dead_letter_dir       string                 `json:"dead_letter_dir,omitempty"`       // for queued mail that could not be saved, queue_dir/dead by default
+	Retry                 map[string]RetryPolicy `json:"retry,omitempty"`                 // by step, eg. "sql", "redis" or "queue"
+	Breaker_failures      int                    `json:"breaker_failures,omitempty"`      // failed saves in a row that make the backend unhealthy, 5 by default
+	Breaker_cooldown      int                    `json:"breaker_cooldown,omitempty"`      // seconds to leave an unhealthy backend alone, 30 by default
+	Save_timeout          int                    `json:"save_timeout,omitempty"`          // seconds a client waits for its message to be saved, 30 by default
+}
+
+// RetryPolicy says how often a step of saving the mail is tried, see GlobalConfig.RetryPolicy
+type RetryPolicy struct {
+	Max_attempts int `json:"max_attempts"`   // including the first one
+	Backoff      int `json:"backoff_ms"`     // milliseconds to wait after the first failure, doubled after each failure
+	Max_backoff  int `json:"max_backoff_ms"` // the longest wait, in milliseconds
 }
 
 type ServerConfig struct {
@@ -38,58 +83,78 @@ type ServerConfig struct {
 	Tls_always_on    bool   `json:"tls_always_on,omitempty"`
 	Max_clients      int    `json:"max_clients"`
 	Log_file         string `json:"log_file"`
+	Allowed_hosts    string `json:"allowed_hosts,omitempty"` // defaults to the global allowed_hosts
+	Verbose          bool   `json:"verbose,omitempty"`
+	Max_recipients   int    `json:"max_recipients,omitempty"`  // per message, 100 by default
+	Spool_dir        string `json:"spool_dir,omitempty"`       // for messages bigger than spool_threshold, the system's temp dir by default
+	Spool_threshold  int    `json:"spool_threshold,omitempty"` // bytes of a message kept in memory, 262144 by default
 }
 
-var mainConfig GlobalConfig
-var flagVerbose, flagIface, flagConfigFile string
-
-// config is read at startup, or when a SIG_HUP is caught
-func readConfig() {
-	log.SetOutput(os.Stdout)
-	// parse command line arguments
-	if !flag.Parsed() {
-		flag.StringVar(&flagConfigFile, "config", "goguerrilla.conf", "Path to the configuration file")
-		flag.StringVar(&flagVerbose, "v", "n", "Verbose, [y | n] ")
-		flag.StringVar(&flagIface, "if", "", "Interface and port to listen on, eg. 127.0.0.1:2525 ")
-		flag.Parse()
+// fill in the defaults for settings that were left out
+func (sConfig *ServerConfig) setDefaults() {
+	if sConfig.Max_recipients == 0 {
+		sConfig.Max_recipients = 100
+	}
+	if sConfig.Spool_threshold == 0 {
+		sConfig.Spool_threshold = 262144
 	}
+}
+
+// ReadConfig loads the configuration from a JSON file.
+// Servers that do not set their own allowed_hosts or verbose inherit the global values.
+func ReadConfig(filename string) (mainConfig GlobalConfig, err error) {
 	// load in the config.
-	b, err := ioutil.ReadFile(flagConfigFile)
+	b, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Fatalln("Could not read config file", err)
+		return mainConfig, errors.New("Could not read config file: " + err.Error())
 	}
-
-	mainConfig = GlobalConfig{}
 	err = json.Unmarshal(b, &mainConfig)
-	//fmt.Println(theConfig)
-	//fmt.Println(fmt.Sprintf("allowed hosts: %s", theConfig.Allowed_hosts))
-	//log.Fatalln("Could not parse config file:", theConfig)
 	if err != nil {
-		fmt.Println("Could not parse config file:", err)
-		log.Fatalln("Could not parse config file:", err)
+		return mainConfig, errors.New("Could not parse config file: " + err.Error())
 	}
-
-	// copy command line flag over so it takes precedence
-	if len(flagVerbose) > 0 && strings.ToUpper(flagVerbose) == "Y" {
-		mainConfig.Verbose = true
-	}
-
-	if len(flagIface) > 0 {
-		mainConfig.Servers[0].Listen_interface = flagIface
-	}
-	// map the allow hosts for easy lookup
-	if len(mainConfig.Allowed_hosts) > 0 {
-		if arr := strings.Split(mainConfig.Allowed_hosts, ","); len(arr) > 0 {
-			for i := 0; i < len(arr); i++ {
-				allowedHosts[arr[i]] = true
-			}
-		}
-	} else {
-		log.Fatalln("Config error, GM_ALLOWED_HOSTS must be s string.")
+	if len(mainConfig.Allowed_hosts) == 0 {
+		return mainConfig, errors.New("Config error, allowed_hosts must be a string.")
 	}
 	if mainConfig.Pid_file == "" {
 		mainConfig.Pid_file = "/var/run/go-guerrilla.pid"
 	}
-
-	return
+	if mainConfig.Shutdown_grace == 0 {
+		mainConfig.Shutdown_grace = 30
+	}
+	if mainConfig.Sql_driver == "" {
+		mainConfig.Sql_driver = "mysql"
+	}
+	if mainConfig.Sql_max_open_conns == 0 {
+		mainConfig.Sql_max_open_conns = mainConfig.Save_workers_size
+	}
+	if mainConfig.Sql_max_idle_conns == 0 {
+		mainConfig.Sql_max_idle_conns = mainConfig.Save_workers_size
+	}
+	if mainConfig.Redis_max_idle == 0 {
+		mainConfig.Redis_max_idle = mainConfig.Save_workers_size
+	}
+	if mainConfig.Redis_max_active == 0 {
+		mainConfig.Redis_max_active = mainConfig.Save_workers_size
+	}
+	if mainConfig.Redis_idle_timeout == 0 {
+		mainConfig.Redis_idle_timeout = 240
+	}
+	if mainConfig.Breaker_failures == 0 {
+		mainConfig.Breaker_failures = 5
+	}
+	if mainConfig.Breaker_cooldown == 0 {
+		mainConfig.Breaker_cooldown = 30
+	}
+	if mainConfig.Save_timeout == 0 {
+		mainConfig.Save_timeout = 30
+	}
+	for i := range mainConfig.Servers {
+		if mainConfig.Servers[i].Allowed_hosts == "" {
+			mainConfig.Servers[i].Allowed_hosts = mainConfig.Allowed_hosts
+		}
+		if mainConfig.Verbose {
+			mainConfig.Servers[i].Verbose = true
+		}
+	}
+	return mainConfig, nil
 }
@@ -0,0 +1,148 @@
+package guerrilla
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The eml backend writes each copy of a message to a file of its own in eml_dir,
+// named by its hash: <hash>.eml. When rotating by date, the files go in a directory
+// for each period, eg. 2016-11-04. When rotating by size, the directories are numbered
+// and a new one is started when the current one is full, eg. 2016-11-04.2 or just 2.
+func init() {
+	RegisterBackend("eml", func() Backend {
+		return &emlBackend{}
+	})
+}
+
+type emlBackend struct {
+	dir         string
+	primaryHost string
+
+	mu       sync.Mutex // guards the fields below
+	rotation rotation
+	period   string
+	seq      int   // of the directory for the period, when rotating by size
+	size     int64 // bytes in the current directory
+}
+
+func (b *emlBackend) Initialize(config GlobalConfig) (err error) {
+	if config.Eml_dir == "" {
+		return errors.New("eml_dir is not set")
+	}
+	b.dir = config.Eml_dir
+	b.primaryHost = config.Primary_host
+	if b.rotation, err = newRotation(config); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(b.dir, 0700); err != nil {
+		return err
+	}
+	return b.resume(time.Now())
+}
+
+// resume carries on with the last directory of the current period, after a restart
+func (b *emlBackend) resume(now time.Time) error {
+	b.period = b.rotation.period(now)
+	b.seq = 1
+	b.size = 0
+	if b.rotation.maxSize == 0 {
+		return nil
+	}
+	prefix := ""
+	if b.period != "" {
+		prefix = b.period + "."
+	}
+	dirs, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range dirs {
+		if !fi.IsDir() || !strings.HasPrefix(fi.Name(), prefix) {
+			continue
+		}
+		if seq, err := strconv.Atoi(fi.Name()[len(prefix):]); err == nil && seq > b.seq {
+			b.seq = seq
+		}
+	}
+	files, _ := ioutil.ReadDir(b.current())
+	for _, fi := range files {
+		b.size += fi.Size()
+	}
+	return nil
+}
+
+// current is the directory the files are written to
+func (b *emlBackend) current() string {
+	name := b.period
+	if b.rotation.maxSize > 0 {
+		if name != "" {
+			name += "."
+		}
+		name += strconv.Itoa(b.seq)
+	}
+	return filepath.Join(b.dir, name)
+}
+
+// next returns the directory for a file of n bytes, starting a new one if needed
+func (b *emlBackend) next(now time.Time, n int64) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if period := b.rotation.period(now); period != b.period {
+		b.period = period
+		b.seq = 1
+		b.size = 0
+	}
+	if b.rotation.full(b.size, n) {
+		b.seq++
+		b.size = 0
+	}
+	b.size += n
+	return b.current()
+}
+
+// Process writes a file for each recipient, the hash of the first copy is returned
+func (b *emlBackend) Process(e *Envelope) (string, error) {
+	return saveCopies(e, b.primaryHost, func(user, host, to, hash string) error {
+		headers := deliveryHeaders(e, to)
+		dir := b.next(time.Now(), int64(len(headers))+e.Size())
+		return b.write(dir, hash, io.MultiReader(strings.NewReader(headers), e.NewReader()))
+	})
+}
+
+// write saves the file under a temporary name first, so that a file named .eml is complete
+func (b *emlBackend) write(dir string, hash string, r io.Reader) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, hash+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, hash+".eml"))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (b *emlBackend) Shutdown() error {
+	return nil
+}
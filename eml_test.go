@@ -0,0 +1,69 @@
+package guerrilla
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEmlRotateSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b := &emlBackend{}
+	if err := b.Initialize(GlobalConfig{Eml_dir: dir, Rotate_size: 100}); err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	for i := 0; i < 2; i++ {
+		hash, err := b.Process(newTestEnvelope("Subject: hi\r\n\r\nhello\r\n", "alice@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	// each copy is bigger than the limit, so each gets a directory of its own
+	for i, hash := range hashes {
+		name := filepath.Join(dir, []string{"1", "2"}[i], hash+".eml")
+		if _, err := os.Stat(name); err != nil {
+			t.Error(err)
+		}
+	}
+	// after a restart, the last directory is carried on with
+	b = &emlBackend{}
+	if err := b.Initialize(GlobalConfig{Eml_dir: dir, Rotate_size: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if current := b.current(); current != filepath.Join(dir, "2") {
+		t.Errorf("carrying on with %s", current)
+	}
+}
+
+func TestEmlRotateDate(t *testing.T) {
+	b := &emlBackend{dir: "eml"}
+	var err error
+	if b.rotation, err = newRotation(GlobalConfig{Rotate_every: "day", Rotate_size: 100}); err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2016, 11, 4, 23, 0, 0, 0, time.UTC)
+	steps := []struct {
+		now  time.Time
+		size int64
+		want string
+	}{
+		{day, 60, "2016-11-04.1"},
+		{day.Add(time.Minute), 30, "2016-11-04.1"},
+		{day.Add(2 * time.Minute), 30, "2016-11-04.2"},
+		{day.Add(2 * time.Hour), 30, "2016-11-05.1"},
+		{day.Add(3 * time.Hour), 30, "2016-11-05.1"},
+	}
+	for i, step := range steps {
+		if got := b.next(step.now, step.size); got != filepath.Join("eml", step.want) {
+			t.Errorf("step %d: got %s, want %s", i, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package guerrilla
+
+import (
+	"os"
+)
+
+// There is no flock on Windows, the file is only locked against the other save workers
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
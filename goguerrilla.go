@@ -13,128 +13,304 @@ See README for more details
 
 */
 
-package main
+// Package guerrilla implements the Go-Guerrilla SMTP server.
+// A Server listens on a single interface, several servers may share one pool of SaveWorkers.
+package guerrilla
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
 	"net"
 	"os"
-	"os/signal"
 	"runtime"
 	"strconv"
-	"syscall"
+	"strings"
+	"sync"
 	"time"
 )
 
-var allowedHosts = make(map[string]bool, 15)
+// ErrServerClosed is returned by Serve and ListenAndServe after a call to Shutdown
+var ErrServerClosed = errors.New("Server closed")
 
+// returned by readSmtp instead of waiting for the next command once Shutdown was called
+var errShuttingDown = errors.New("Server shutting down")
 
-var signalChannel = make(chan os.Signal, 1) // for trapping SIG_HUB
+type Server struct {
+	saveWorkers *SaveWorkers
 
-func sigHandler() {
-	for sig := range signalChannel {
-		if sig == syscall.SIGHUP {
-			readConfig()
-			fmt.Print("Reloading Configuration!\n")
-		} else {
-			os.Exit(0)
-		}
+	mu           sync.Mutex // guards the fields below
+	config       ServerConfig
+	tlsConfig    *tls.Config
+	allowedHosts map[string]bool
+	sem          chan int // currently active client list
+	logger       *log.Logger
+	logFile      *os.File // the file logger writes to, nil if none
+	listener     net.Listener
+	clients      map[*Client]net.Conn // the raw connection of each client
+	clientsWg    sync.WaitGroup
+	shuttingDown bool
+}
 
+// NewServer creates a server from sConfig, accepted mail is passed on to saveWorkers
+func NewServer(sConfig ServerConfig, saveWorkers *SaveWorkers) (*Server, error) {
+	sConfig.setDefaults()
+	server := &Server{
+		config:      sConfig,
+		sem:         make(chan int, sConfig.Max_clients),
+		saveWorkers: saveWorkers,
+		clients:     make(map[*Client]net.Conn),
 	}
-}
+	// setup logging
+	server.logger, server.logFile = openLog(sConfig)
 
-func initialise() {
+	server.allowedHosts = mapAllowedHosts(sConfig.Allowed_hosts)
+	tlsConfig, err := loadTlsConfig(sConfig)
+	if err != nil {
+		return nil, err
+	}
+	server.tlsConfig = tlsConfig
+	return server, nil
+}
 
-	// database writing workers
-	SaveMailChan = make(chan *savePayload, mainConfig.Save_workers_size)
+// Reload applies sConfig to a running server without dropping its clients.
+// The certificates are loaded again, new clients get the new configuration while
+// connected clients keep theirs, except for the allowed hosts which apply to all clients.
+// The listen interface cannot be changed.
+func (server *Server) Reload(sConfig ServerConfig) error {
+	sConfig.setDefaults()
+	current := server.Config()
+	if sConfig.Listen_interface != current.Listen_interface {
+		return errors.New("Cannot change the listen interface of a running server")
+	}
+	tlsConfig, err := loadTlsConfig(sConfig)
+	if err != nil {
+		return err
+	}
+	allowedHosts := mapAllowedHosts(sConfig.Allowed_hosts)
+	var logger *log.Logger
+	var logFile, oldLogFile *os.File
+	if sConfig.Log_file != current.Log_file {
+		logger, logFile = openLog(sConfig)
+	}
 
-	// write out our PID
-	if f, err := os.Create(mainConfig.Pid_file); err == nil {
-		defer f.Close()
-		if _, err := f.WriteString(strconv.Itoa(os.Getpid())); err == nil {
-			f.Sync()
-		}
+	server.mu.Lock()
+	server.config = sConfig
+	server.tlsConfig = tlsConfig
+	server.allowedHosts = allowedHosts
+	if logger != nil {
+		server.logger = logger
+		oldLogFile, server.logFile = server.logFile, logFile
+	}
+	if sConfig.Max_clients != current.Max_clients {
+		// connected clients give back their slot to the old sem
+		server.sem = make(chan int, sConfig.Max_clients)
+	}
+	server.mu.Unlock()
+	if oldLogFile != nil {
+		oldLogFile.Close()
 	}
-	// handle SIGHUP for reloading the configuration while running
-	signal.Notify(signalChannel, syscall.SIGHUP)
+	return nil
+}
 
-	return
+// Config returns the configuration the server is currently running with
+func (server *Server) Config() ServerConfig {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.config
 }
 
-func runServer(sConfig ServerConfig) (err error) {
-	server := SmtpdServer{Config: sConfig, sem: make(chan int, sConfig.Max_clients)}
+func (server *Server) getTlsConfig() *tls.Config {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.tlsConfig
+}
 
-	// setup logging
-	server.openLog()
+func (server *Server) getAllowedHosts() map[string]bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.allowedHosts
+}
 
-	// configure ssl
-	if (sConfig.Tls_always_on || sConfig.Start_tls_on) {
-		cert, err := tls.LoadX509KeyPair(sConfig.Public_key_file, sConfig.Private_key_file)
-		if err != nil {
-			server.logln(2, fmt.Sprintf("There was a problem with loading the certificate: %s", err))
-		}
-		server.tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			ClientAuth:   tls.VerifyClientCertIfGiven,
-			ServerName:   sConfig.Host_name,
+// map the allowed hosts for easy lookup
+func mapAllowedHosts(allowed string) map[string]bool {
+	allowedHosts := make(map[string]bool, 15)
+	if len(allowed) > 0 {
+		if arr := strings.Split(allowed, ","); len(arr) > 0 {
+			for i := 0; i < len(arr); i++ {
+				allowedHosts[strings.ToLower(arr[i])] = true
+			}
 		}
-		server.tlsConfig.Rand = rand.Reader
 	}
+	return allowedHosts
+}
 
+// configure ssl, returns nil if TLS is not enabled
+func loadTlsConfig(sConfig ServerConfig) (*tls.Config, error) {
+	if !sConfig.Tls_always_on && !sConfig.Start_tls_on {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(sConfig.Public_key_file, sConfig.Private_key_file)
+	if err != nil {
+		return nil, fmt.Errorf("There was a problem with loading the certificate: %s", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ServerName:   sConfig.Host_name,
+	}
+	tlsConfig.Rand = rand.Reader
+	return tlsConfig, nil
+}
 
-	// configure timeout
-	server.timeout = time.Duration(sConfig.Timeout)
-
+// ListenAndServe listens on the configured Listen_interface and then calls Serve
+func (server *Server) ListenAndServe() error {
 	// Start listening for SMTP connections
-	listener, err := net.Listen("tcp", sConfig.Listen_interface)
+	listener, err := net.Listen("tcp", server.Config().Listen_interface)
 	if err != nil {
-		server.logln(2, fmt.Sprintf("Cannot listen on port, %v", err))
+		server.logln(1, fmt.Sprintf("Cannot listen on port, %v", err))
 		return err
-	} else {
-		server.logln(1, fmt.Sprintf("Listening on tcp %s", sConfig.Listen_interface))
 	}
+	return server.Serve(listener)
+}
+
+// Serve accepts connections on listener, starting a new goroutine for each client.
+// It always returns a non-nil error, ErrServerClosed after Shutdown was called.
+func (server *Server) Serve(listener net.Listener) error {
+	server.mu.Lock()
+	if server.shuttingDown {
+		server.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	server.listener = listener
+	server.mu.Unlock()
+	server.logln(1, fmt.Sprintf("Listening on tcp %s", listener.Addr()))
+
 	var clientId int64
 	clientId = 1
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if server.isShuttingDown() {
+				return ErrServerClosed
+			}
 			server.logln(1, fmt.Sprintf("Accept error: %s", err))
 			continue
 		}
 		server.logln(0, fmt.Sprintf(" There are now "+strconv.Itoa(runtime.NumGoroutine())+" serving goroutines"))
-		server.sem <- 1 // Wait for active queue to drain.
-		go server.handleClient(&Client{
-			conn:        conn,
-			address:     conn.RemoteAddr().String(),
-			time:        time.Now().Unix(),
-			bufin:       newSmtpBufferedReader(conn),
-			bufout:      bufio.NewWriter(conn),
-			clientId:    clientId,
-			savedNotify: make(chan int),
-		})
+		server.mu.Lock()
+		sem := server.sem
+		server.mu.Unlock()
+		sem <- 1 // Wait for active queue to drain.
+		client := &Client{
+			conn:     conn,
+			address:  conn.RemoteAddr().String(),
+			time:     time.Now().Unix(),
+			bufin:    newSmtpBufferedReader(conn),
+			bufout:   bufio.NewWriter(conn),
+			clientId: clientId,
+			sem:      sem,
+		}
+		if !server.addClient(client) {
+			// Shutdown was called while we were accepting
+			conn.Close()
+			<-sem
+			return ErrServerClosed
+		}
+		go server.handleClient(client)
 		clientId++
 	}
 }
 
-func main() {
-	readConfig()
-	initialise()
-	if err := testDbConnections(); err != nil {
-		fmt.Println(err)
-		os.Exit(1);
+// Shutdown stops accepting new connections and waits for the connected clients to finish.
+// Clients waiting for a command are sent a 421 reply and disconnected,
+// clients sending DATA may finish their message first.
+// If ctx is done before that, the remaining connections are closed and ctx.Err() is returned.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	server.shuttingDown = true
+	listener := server.listener
+	for client, conn := range server.clients {
+		if client.idle {
+			// wake it up from waiting for a command
+			conn.SetReadDeadline(time.Now())
+		}
 	}
-	// start some savemail workers
-	for i := 0; i < mainConfig.Save_workers_size; i++ {
-		go saveMail()
+	server.mu.Unlock()
+	if listener != nil {
+		listener.Close()
 	}
-	// run our servers
-	for serverId := 0; serverId < len(mainConfig.Servers); serverId++ {
-		if mainConfig.Servers[serverId].Is_enabled {
-			go runServer(mainConfig.Servers[serverId])
+	done := make(chan struct{})
+	go func() {
+		server.clientsWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		server.mu.Lock()
+		for _, conn := range server.clients {
+			conn.Close()
 		}
+		server.mu.Unlock()
+		// a client may still be waiting for its message to be saved
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (server *Server) isShuttingDown() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.shuttingDown
+}
+
+// keep track of the client so that Shutdown can wait for it, returns false if shutting down
+func (server *Server) addClient(client *Client) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.shuttingDown {
+		return false
+	}
+	server.clients[client] = client.conn
+	client.config = server.config
+	server.clientsWg.Add(1)
+	return true
+}
+
+// setDeadline is called before each read from the client.
+// A client reading a command is idle, so that Shutdown can interrupt it,
+// unless it is between the BDAT chunks of a message.
+func (server *Server) setDeadline(client *Client) error {
+	if client.state != 1 || client.smtpState == smtpData {
+		client.conn.SetDeadline(time.Now().Add(time.Duration(client.config.Timeout) * time.Second))
+		return nil
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.shuttingDown {
+		return errShuttingDown
 	}
-	sigHandler()
+	client.idle = true
+	client.conn.SetDeadline(time.Now().Add(time.Duration(client.config.Timeout) * time.Second))
+	return nil
+}
+
+func (server *Server) setBusy(client *Client) {
+	server.mu.Lock()
+	client.idle = false
+	server.mu.Unlock()
+}
+
+func (server *Server) removeClient(client *Client) {
+	server.mu.Lock()
+	delete(server.clients, client)
+	server.mu.Unlock()
+	server.clientsWg.Done()
 }
@@ -0,0 +1,359 @@
+package guerrilla
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// The default backend, as used by GuerrillaMail.com.
+// Meta-data is saved to an SQL database and the compressed message to Redis.
+// If Redis is not available, the compressed message is saved to the database instead.
+// The database driver has to be imported by the program, eg. github.com/go-sql-driver/mysql
+// The backend is a chain of processors, the redis and sql processors are defined here.
+func init() {
+	RegisterBackend("guerrilla-db-redis", func() Backend {
+		return newChain(guerrillaDbRedisProcess)
+	})
+	RegisterProcessor("redis", func() Processor {
+		return &redisProcessor{}
+	})
+	RegisterProcessor("sql", func() Processor {
+		return &sqlProcessor{}
+	})
+}
+
+// The processors of the guerrilla-db-redis backend
+const guerrillaDbRedisProcess = "headers|hash|compress|redis|sql"
+
+// The statement saving a copy of the message when sql_insert is not set, for the GuerrillaMail schema
+const defaultSqlInsert = "INSERT INTO {table} " +
+	"(`date`, `to`, `from`, `subject`, `body`, `charset`, `mail`, `spam_score`, `hash`, `content_type`, `recipient`, `has_attach`, `attach_info`, `ip_addr`, `return_path`, `is_tls`)" +
+	" values (NOW(), {to}, {from}, {subject}, {body}, {charset}, {mail}, 0, {hash}, {content_type}, {recipient}, {has_attach}, {attach_info}, {ip_addr}, {return_path}, {is_tls})"
+
+// The values that can be used in sql_insert, as {name}.
+// {table} is not a value, it is replaced by mail_table.
+var sqlValueNames = map[string]bool{
+	"date":         true, // the time the copy was saved
+	"to":           true, // the recipient at primary_mail_host
+	"recipient":    true, // the recipient as given in RCPT TO
+	"from":         true,
+	"return_path":  true, // the same as from
+	"subject":      true, // decoded
+	"body":         true, // where the message is: "redis" or "gzencode" if it is in mail
+	"mail":         true, // the compressed message, empty if it was saved to Redis
+	"hash":         true, // the key of the message in Redis
+	"ip_addr":      true,
+	"helo":         true,
+	"is_tls":       true,
+	"content_type": true, // of the message, empty without the mime processor
+	"charset":      true, // of the first text part, "UTF-8" without the mime processor
+	"has_attach":   true, // 1 if the message has attachments
+	"attach_count": true,
+	"attach_info":  true, // the attachments as a JSON array, see MimePart
+}
+
+var sqlValueRegex = regexp.MustCompile(`\{(\w+)\}`)
+
+// redisProcessor saves each compressed copy in Redis by its hash, then sets e.Values["body"],
+// a []string with "redis" for each copy saved, or "gzencode" if Redis failed.
+// If a later processor fails, the keys of the copies it did not save are deleted.
+// The hash and compress processors have to come before it.
+type redisProcessor struct {
+	config GlobalConfig
+	pool   *redis.Pool
+}
+
+func (r *redisProcessor) Initialize(config GlobalConfig) error {
+	conn, err := redisDial(config)
+	if err != nil {
+		return errors.New("Redis cannot connect, check your settings. " + err.Error())
+	}
+	conn.Close()
+	r.config = config
+	r.pool = newRedisPool(config)
+	return nil
+}
+
+func (r *redisProcessor) Process(e *Envelope, next ProcessFunc) (string, error) {
+	compressed, _ := e.Values["compressed"].([]string)
+	if len(e.Hashes) != len(e.RcptTo) || len(compressed) != len(e.RcptTo) {
+		return "", errors.New("redis: the hash and compress processors must come before it")
+	}
+	ctx, cancel := deadlineContext(e)
+	defer cancel()
+	hashes := e.Hashes
+	body := make([]string, len(e.RcptTo))
+	for i := range e.RcptTo {
+		body[i] = "gzencode"
+		redis_err := r.config.RetryPolicy("redis").Do(ctx, func() error {
+			_, err := redisDo(ctx, r.pool, "SETEX", hashes[i], r.config.Redis_expire_seconds, compressed[i])
+			return err
+		})
+		if redis_err == nil {
+			body[i] = "redis"
+		} else {
+			log.Printf("redis: %v, saving the message to the database instead", redis_err)
+		}
+	}
+	e.Values["body"] = body
+	id, err := next(e)
+	if err != nil {
+		// nothing points to the keys of the copies left in e.RcptTo, they are saved again
+		// if the message is tried again from the queue, a client sends it as a new message
+		var orphans []interface{}
+		for i := len(hashes) - len(e.RcptTo); i < len(hashes); i++ {
+			if body[i] == "redis" {
+				orphans = append(orphans, hashes[i])
+			}
+		}
+		if len(orphans) > 0 {
+			if _, del_err := redisDo(ctx, r.pool, "DEL", orphans...); del_err != nil {
+				log.Printf("redis: cannot delete the keys of the copies that were not saved: %v", del_err)
+			}
+		}
+	}
+	return id, err
+}
+
+// redisDo runs a command on a connection from pool.
+// If ctx has a deadline, the connection and the reply are not waited for past it.
+func redisDo(ctx context.Context, pool *redis.Pool, cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return conn.Do(cmd, args...)
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	return redis.DoWithTimeout(conn, timeout, cmd, args...)
+}
+
+func (r *redisProcessor) Shutdown() error {
+	if r.pool == nil {
+		return nil
+	}
+	return r.pool.Close()
+}
+
+// sqlProcessor saves a row for each copy with the sql_insert statement.
+// The hash processor has to come before it. The compressed copy is saved in the row
+// unless the redis processor saved it.
+type sqlProcessor struct {
+	config GlobalConfig
+	db     *sql.DB
+	ins    *sql.Stmt
+	values []string  // the names of the values to bind to ins, in order
+	incr   *sql.Stmt // nil if there is no sql_counter
+}
+
+func (s *sqlProcessor) Initialize(config GlobalConfig) error {
+	s.config = config
+	db, err := openSqlDb(config)
+	if err == nil {
+		if err = db.Ping(); err != nil {
+			db.Close()
+		}
+	}
+	if err != nil {
+		return errors.New("Database cannot connect, check your settings. " + err.Error())
+	}
+	s.db = db
+	insert := config.Sql_insert
+	if insert == "" {
+		insert = defaultSqlInsert
+	}
+	insert, s.values, err = sqlTemplate(insert, config.Sql_driver, config.Mysql_table)
+	if err == nil {
+		if s.ins, err = db.Prepare(insert); err != nil {
+			err = fmt.Errorf("Sql statement incorrect: %s", err)
+		}
+	}
+	if err == nil && config.Sql_counter != "" {
+		if s.incr, err = db.Prepare(config.Sql_counter); err != nil {
+			err = fmt.Errorf("Sql statement incorrect: %s", err)
+		}
+	}
+	if err != nil {
+		s.Shutdown()
+	}
+	return err
+}
+
+func (s *sqlProcessor) Process(e *Envelope, next ProcessFunc) (string, error) {
+	if len(e.Hashes) != len(e.RcptTo) {
+		return "", errors.New("sql: the hash processor must come before it")
+	}
+	compressed, _ := e.Values["compressed"].([]string)
+	body, _ := e.Values["body"].([]string)
+	subject := mimeHeaderDecode(e.Subject)
+	ctx, cancel := deadlineContext(e)
+	defer cancel()
+	for i, rcpt := range e.RcptTo {
+		to, recipient, err := primaryAddress(rcpt, s.config.Primary_host)
+		if err != nil {
+			dropSaved(e, i)
+			return "", err
+		}
+		values := map[string]interface{}{
+			"date":        time.Now(),
+			"to":          to,
+			"recipient":   recipient,
+			"from":        e.MailFrom,
+			"return_path": e.MailFrom,
+			"subject":     subject,
+			"body":        "",
+			"mail":        "",
+			"hash":        e.Hashes[i],
+			"ip_addr":     e.RemoteAddress,
+			"helo":        e.Helo,
+			"is_tls":      e.TLS,
+		}
+		for name, value := range attachValues(e.Parsed) {
+			values[name] = value
+		}
+		if i < len(body) && body[i] == "redis" {
+			values["body"] = "redis"
+		} else if i < len(compressed) {
+			values["body"] = "gzencode"
+			values["mail"] = compressed[i]
+		}
+		args := make([]interface{}, len(s.values))
+		for i, name := range s.values {
+			args[i] = values[name]
+		}
+		// save, discard result
+		err = s.config.RetryPolicy("sql").Do(ctx, func() error {
+			_, err := s.ins.ExecContext(ctx, args...)
+			return err
+		})
+		if err != nil {
+			dropSaved(e, i)
+			return "", fmt.Errorf("Database error, %v", err)
+		}
+		if s.incr != nil {
+			if _, err := s.incr.ExecContext(ctx); err != nil {
+				log.Printf("Failed to incr count: %v", err)
+			}
+		}
+	}
+	return next(e)
+}
+
+// attachValues are the sql values from the MIME structure, the defaults if parsed is nil
+func attachValues(parsed *ParsedMessage) map[string]interface{} {
+	values := map[string]interface{}{
+		"content_type": "",
+		"charset":      "UTF-8",
+		"has_attach":   0,
+		"attach_count": 0,
+		"attach_info":  "",
+	}
+	if parsed == nil {
+		return values
+	}
+	values["content_type"] = parsed.ContentType
+	values["charset"] = parsed.Charset
+	if attachments := parsed.Attachments(); len(attachments) > 0 {
+		values["has_attach"] = 1
+		values["attach_count"] = len(attachments)
+		if info, err := json.Marshal(attachments); err == nil {
+			values["attach_info"] = string(info)
+		}
+	}
+	return values
+}
+
+func (s *sqlProcessor) Shutdown() error {
+	if s.db == nil {
+		return nil
+	}
+	if s.ins != nil {
+		s.ins.Close()
+	}
+	if s.incr != nil {
+		s.incr.Close()
+	}
+	return s.db.Close()
+}
+
+// openSqlDb opens the database with the pool limits from the config.
+// Without sql_dsn, the data source name for MySQL is made from the mysql_ settings.
+func openSqlDb(config GlobalConfig) (*sql.DB, error) {
+	dsn := config.Sql_dsn
+	if dsn == "" && config.Sql_driver == "mysql" {
+		dsn = config.Mysql_user + ":" + config.Mysql_pass +
+			"@tcp(" + config.Mysql_host + ")/" + config.Mysql_db + "?charset=utf8"
+	}
+	db, err := sql.Open(config.Sql_driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(config.Sql_max_open_conns)
+	db.SetMaxIdleConns(config.Sql_max_idle_conns)
+	db.SetConnMaxLifetime(time.Duration(config.Sql_conn_max_lifetime) * time.Second)
+	return db, nil
+}
+
+// sqlTemplate replaces the {name} values of statement with the placeholders of the driver,
+// returns the statement and the names of the values in the order of the placeholders
+func sqlTemplate(statement string, driver string, table string) (string, []string, error) {
+	var names []string
+	var err error
+	statement = sqlValueRegex.ReplaceAllStringFunc(statement, func(m string) string {
+		name := m[1 : len(m)-1]
+		if name == "table" {
+			return table
+		}
+		if !sqlValueNames[name] {
+			err = errors.New("Unknown value in sql statement: " + m)
+			return m
+		}
+		names = append(names, name)
+		if driver == "postgres" || driver == "pgx" {
+			return "$" + strconv.Itoa(len(names))
+		}
+		return "?"
+	})
+	return statement, names, err
+}
+
+// newRedisPool makes a pool of Redis connections shared by the save workers.
+// A connection is checked with a PING before it is used, a broken one is dialed again.
+func newRedisPool(config GlobalConfig) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     config.Redis_max_idle,
+		MaxActive:   config.Redis_max_active,
+		IdleTimeout: time.Duration(config.Redis_idle_timeout) * time.Second,
+		Wait:        true,
+		Dial: func() (redis.Conn, error) {
+			return redisDial(config)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+func redisDial(config GlobalConfig) (redis.Conn, error) {
+	return redis.Dial("tcp", config.Redis_interface,
+		redis.DialPassword(config.Redis_password),
+		redis.DialDatabase(config.Redis_db),
+		redis.DialConnectTimeout(10*time.Second),
+		redis.DialReadTimeout(30*time.Second),
+		redis.DialWriteTimeout(30*time.Second))
+}
@@ -0,0 +1,124 @@
+package guerrilla
+
+import (
+	"bufio"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Header is the header of a message, see ReadHeader.
+// The names are canonical, eg. "Message-Id", the values are unfolded but not decoded.
+type Header map[string][]string
+
+// ReadHeader reads the header of a message from r, up to the first blank line.
+// Folded lines are unfolded, a field found more than once has all its values in order.
+// Lines that are not fields are skipped. If r fails, the fields read so far are returned with the error.
+func ReadHeader(r io.Reader) (Header, error) {
+	h := make(Header)
+	br := bufio.NewReader(r)
+	var name string // of the last field, to add the continuation lines to
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return h, err
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			// the end of the header, or of the message
+			return h, nil
+		}
+		if trimmed[0] == ' ' || trimmed[0] == '\t' {
+			if name != "" {
+				values := h[name]
+				values[len(values)-1] += trimmed
+			}
+		} else if i := strings.IndexByte(trimmed, ':'); i > 0 && validFieldName(trimmed[:i]) {
+			name = textproto.CanonicalMIMEHeaderKey(trimmed[:i])
+			h[name] = append(h[name], strings.TrimLeft(trimmed[i+1:], " \t"))
+		} else {
+			// eg. the "From " line of mbox
+			name = ""
+		}
+		if err == io.EOF {
+			return h, nil
+		}
+	}
+}
+
+// validFieldName tells if s can be the name of a field, printable ASCII without a colon, RFC 5322 section 2.2
+func validFieldName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 33 || s[i] > 126 {
+			return false
+		}
+	}
+	return true
+}
+
+// Get returns the first value of the field name, not decoded. Empty if there is none.
+func (h Header) Get(name string) string {
+	if values := h[textproto.CanonicalMIMEHeaderKey(name)]; len(values) > 0 {
+		return strings.TrimSpace(values[0])
+	}
+	return ""
+}
+
+// Decoded returns the first value of the field name with its encoded words decoded,
+// eg. "=?UTF-8?B?aMOp?=" is "hé"
+func (h Header) Decoded(name string) string {
+	return mimeHeaderDecode(h.Get(name))
+}
+
+// Subject is the decoded Subject
+func (h Header) Subject() string {
+	return h.Decoded("Subject")
+}
+
+// MessageID is the Message-ID, without the angle brackets
+func (h Header) MessageID() string {
+	return strings.Trim(h.Get("Message-Id"), "<>")
+}
+
+// Date is the Date of the message
+func (h Header) Date() (time.Time, error) {
+	return mail.ParseDate(h.Get("Date"))
+}
+
+// From returns the addresses in From, with the names decoded
+func (h Header) From() ([]*mail.Address, error) {
+	return h.Addresses("From")
+}
+
+// To returns the addresses in To, with the names decoded
+func (h Header) To() ([]*mail.Address, error) {
+	return h.Addresses("To")
+}
+
+// Cc returns the addresses in Cc, with the names decoded
+func (h Header) Cc() ([]*mail.Address, error) {
+	return h.Addresses("Cc")
+}
+
+// ReplyTo returns the addresses in Reply-To, with the names decoded
+func (h Header) ReplyTo() ([]*mail.Address, error) {
+	return h.Addresses("Reply-To")
+}
+
+// Addresses returns the addresses in all the name fields, with the names decoded
+func (h Header) Addresses(name string) ([]*mail.Address, error) {
+	var list []*mail.Address
+	for _, value := range h[textproto.CanonicalMIMEHeaderKey(name)] {
+		addresses, err := addressParser.ParseList(value)
+		if err != nil {
+			return list, err
+		}
+		list = append(list, addresses...)
+	}
+	return list, nil
+}
+
+// addressParser decodes the names in the charsets mimeHeaderDecode knows
+var addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
@@ -0,0 +1,117 @@
+package guerrilla
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   Header
+	}{
+		{
+			name:   "one field",
+			header: "Subject: hi\r\n\r\nhello\r\n",
+			want:   Header{"Subject": {"hi"}},
+		},
+		{
+			name:   "folded",
+			header: "Subject: a long\r\n  subject\r\n\tindeed\r\nTo: alice@example.com\r\n\r\n",
+			want:   Header{"Subject": {"a long  subject\tindeed"}, "To": {"alice@example.com"}},
+		},
+		{
+			name:   "duplicate",
+			header: "Received: from a\r\nreceived: from b\r\n by c\r\n\r\n",
+			want:   Header{"Received": {"from a", "from b by c"}},
+		},
+		{
+			name:   "canonical names",
+			header: "message-id: <1@example.com>\r\nCONTENT-TYPE: text/plain\r\n\r\n",
+			want:   Header{"Message-Id": {"<1@example.com>"}, "Content-Type": {"text/plain"}},
+		},
+		{
+			name:   "LF line endings and no body",
+			header: "Subject: hi\nFrom: bob@example.com",
+			want:   Header{"Subject": {"hi"}, "From": {"bob@example.com"}},
+		},
+		{
+			name:   "not fields",
+			header: "From bob@example.com Mon Jan  2 15:04:05 2006\r\n  continued\r\nSubject: hi\r\nno colon here\r\n\r\n",
+			want:   Header{"Subject": {"hi"}},
+		},
+		{
+			name:   "empty value",
+			header: "Subject:\r\nTo: alice@example.com\r\n\r\n",
+			want:   Header{"Subject": {""}, "To": {"alice@example.com"}},
+		},
+		{
+			name:   "the body is not read",
+			header: "Subject: hi\r\n\r\nTo: alice@example.com\r\n",
+			want:   Header{"Subject": {"hi"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, err := ReadHeader(strings.NewReader(test.header))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(h, test.want) {
+				t.Errorf("got %q, want %q", h, test.want)
+			}
+		})
+	}
+}
+
+// brokenReader returns s, then fails
+type brokenReader struct {
+	s string
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	if r.s == "" {
+		return 0, errors.New("Broken")
+	}
+	n := copy(p, r.s)
+	r.s = r.s[n:]
+	return n, nil
+}
+
+func TestReadHeaderError(t *testing.T) {
+	h, err := ReadHeader(&brokenReader{"Subject: hi\r\nTo: alice"})
+	if err == nil || err == io.EOF {
+		t.Fatalf("got %v", err)
+	}
+	if h.Get("Subject") != "hi" {
+		t.Errorf("got %q", h)
+	}
+}
+
+func TestHeaderDecoded(t *testing.T) {
+	h := Header{
+		"Subject": {" =?UTF-8?B?aMOp?= =?UTF-8?Q?_l=C3=A0?= "},
+		"From":    {"=?ISO-8859-1?Q?Ren=E9?= <rene@example.com>", "bob@example.com"},
+		"Cc":      {"not an address"},
+	}
+	if got := h.Subject(); got != "hé là" {
+		t.Errorf("Subject %q", got)
+	}
+	from, err := h.From()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(from) != 2 || from[0].Name != "René" || from[0].Address != "rene@example.com" || from[1].Address != "bob@example.com" {
+		t.Errorf("From %v", from)
+	}
+	if _, err := h.Cc(); err == nil {
+		t.Error("Cc parsed")
+	}
+	if to, err := h.To(); err != nil || len(to) != 0 {
+		t.Errorf("To %v, %v", to, err)
+	}
+}
@@ -0,0 +1,194 @@
+package guerrilla
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IDGenerator makes the queue ids: the id of each message, shown in the logs and the
+// Received header, and the hash of each copy, eg. the key of the copy in Redis.
+// The ids are used in the names of files, so they should only have letters, digits and '-',
+// and they are saved in the hash column of the GuerrillaMail schema, so they should fit in 32 characters.
+// NewID is called by several workers at the same time, so it must be safe for concurrent use.
+type IDGenerator interface {
+	// NewID returns a new id, for a copy for to if to is not empty
+	NewID(to string, from string, subject string) string
+}
+
+// The generator used when queue_id_generator is not set
+const DefaultIDGeneratorName = "ulid"
+
+var idGeneratorsMu sync.Mutex
+var idGenerators = make(map[string]func(node string) IDGenerator)
+
+// idGenerator is the generator in use, see SetIDGenerator
+var idGenerator IDGenerator
+
+// RegisterIDGenerator makes a generator available by name for the queue_id_generator config setting.
+// node is the node_id setting, to keep the ids of different servers apart.
+// Two generators can't share a name, the second one registered panics.
+func RegisterIDGenerator(name string, factory func(node string) IDGenerator) {
+	idGeneratorsMu.Lock()
+	defer idGeneratorsMu.Unlock()
+	if _, dup := idGenerators[name]; dup {
+		panic("guerrilla: RegisterIDGenerator called twice for " + name)
+	}
+	idGenerators[name] = factory
+}
+
+func init() {
+	RegisterIDGenerator("ulid", func(node string) IDGenerator {
+		return &ulidGenerator{prefix: nodePrefix(node)}
+	})
+	RegisterIDGenerator("random", func(node string) IDGenerator {
+		return &randomGenerator{prefix: nodePrefix(node)}
+	})
+	RegisterIDGenerator("md5", func(node string) IDGenerator {
+		return md5Generator{}
+	})
+	SetIDGenerator("", "")
+}
+
+// SetIDGenerator makes the queue ids with the generator name, DefaultIDGeneratorName if empty.
+// node is a name for the server, unique among the servers saving to the same place,
+// the first part of the hostname if empty. Calling it again replaces the generator,
+// the mail being saved at that time may get ids from either.
+func SetIDGenerator(name string, node string) error {
+	if name == "" {
+		name = DefaultIDGeneratorName
+	}
+	if node == "" {
+		hostname, _ := os.Hostname()
+		node = strings.SplitN(hostname, ".", 2)[0]
+	}
+	idGeneratorsMu.Lock()
+	defer idGeneratorsMu.Unlock()
+	factory, ok := idGenerators[name]
+	if !ok {
+		return errors.New("Unknown queue id generator: " + name)
+	}
+	idGenerator = factory(node)
+	return nil
+}
+
+// newID returns a new id from the generator in use
+func newID(to string, from string, subject string) string {
+	idGeneratorsMu.Lock()
+	g := idGenerator
+	idGeneratorsMu.Unlock()
+	return g.NewID(to, from, subject)
+}
+
+// The longest node kept as it is in the ids, so that a ULID after it fits in 32 characters
+const nodeMaxLength = 5
+
+// nodePrefix makes node safe to use in a file name or a Redis key, followed by a '-'.
+// A node longer than nodeMaxLength is replaced by as many characters of its SHA-256.
+func nodePrefix(node string) string {
+	node = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return -1
+	}, node)
+	if node == "" {
+		return ""
+	}
+	if len(node) > nodeMaxLength {
+		sum := sha256.Sum256([]byte(node))
+		bits := binary.BigEndian.Uint64(sum[:8])
+		short := make([]byte, nodeMaxLength)
+		for i := range short {
+			short[i] = ulidAlphabet[bits>>59]
+			bits <<= 5
+		}
+		node = string(short)
+	}
+	return node + "-"
+}
+
+// ulidGenerator makes ULIDs (https://github.com/ulid/spec) after the node: 48 bits of time
+// in milliseconds then 80 random bits, sorting by time. Within the same millisecond the random
+// bits are incremented, so that the ids of a node never repeat.
+type ulidGenerator struct {
+	prefix string
+	mu     sync.Mutex
+	last   [16]byte
+}
+
+// Crockford's base32, without I, L, O and U
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (g *ulidGenerator) NewID(to string, from string, subject string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	last := binary.BigEndian.Uint64(g.last[:8]) >> 16
+	var id [16]byte
+	if ms <= last {
+		// the same millisecond, or the clock went back
+		id = g.last
+		for i := 15; i >= 0; i-- {
+			id[i]++
+			if id[i] != 0 {
+				break
+			}
+		}
+	} else {
+		binary.BigEndian.PutUint64(id[:8], ms<<16)
+		if _, err := rand.Read(id[6:]); err != nil {
+			// still unique, the random bits are only incremented after this
+			binary.BigEndian.PutUint64(id[8:], uint64(time.Now().UnixNano()))
+		}
+	}
+	g.last = id
+	return g.prefix + encodeULID(id)
+}
+
+// encodeULID writes the 128 bits of id as 26 characters of base32, 5 bits each from the end
+func encodeULID(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = ulidAlphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// randomGenerator makes random hex digits after the node, up to 32 characters:
+// 128 random bits without a node, at least 104 with one
+type randomGenerator struct {
+	prefix string
+}
+
+func (g *randomGenerator) NewID(to string, from string, subject string) string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		binary.BigEndian.PutUint64(id[:8], uint64(time.Now().UnixNano()))
+	}
+	return g.prefix + hex.EncodeToString(id[:])[len(g.prefix):]
+}
+
+// md5Generator makes the ids as before there were generators, the MD5 of the recipient,
+// the sender, the subject and the time in nanoseconds. They are not guaranteed to be unique.
+type md5Generator struct{}
+
+func (md5Generator) NewID(to string, from string, subject string) string {
+	ts := strconv.FormatInt(time.Now().UnixNano(), 10)
+	return md5hex(
+		&to,
+		&from,
+		&subject,
+		&ts)
+}
@@ -0,0 +1,58 @@
+package guerrilla
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestIDLength(t *testing.T) {
+	for _, name := range []string{"ulid", "random", "md5"} {
+		for _, node := range []string{"", "mx1", "mail-relay-01.example.com"} {
+			g := idGenerators[name](node)
+			if id := g.NewID("alice@example.com", "sender@example.org", "hi"); len(id) > 32 {
+				t.Errorf("%s with node %q: %q is longer than 32 characters", name, node, id)
+			}
+		}
+	}
+}
+
+func TestNodePrefix(t *testing.T) {
+	if prefix := nodePrefix("mx.1"); prefix != "mx1-" {
+		t.Errorf("mx.1 gives %q", prefix)
+	}
+	long := nodePrefix("mail-relay-01")
+	if len(long) != nodeMaxLength+1 || long == nodePrefix("mail-relay-02") {
+		t.Errorf("mail-relay-01 gives %q, mail-relay-02 %q", long, nodePrefix("mail-relay-02"))
+	}
+}
+
+func TestULIDOrder(t *testing.T) {
+	g := &ulidGenerator{prefix: nodePrefix("mx1")}
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var ids []string
+			for i := 0; i < 1000; i++ {
+				ids = append(ids, g.NewID("", "", ""))
+			}
+			if !sort.StringsAreSorted(ids) {
+				t.Error("the ids of a goroutine are not in order")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, id := range ids {
+				if seen[id] || !strings.HasPrefix(id, "mx1-") {
+					t.Errorf("%q repeated or without the node", id)
+				}
+				seen[id] = true
+			}
+		}()
+	}
+	wg.Wait()
+}
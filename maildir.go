@@ -0,0 +1,125 @@
+package guerrilla
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The maildir backend delivers a copy of each message to the Maildir of each recipient,
+// see http://cr.yp.to/proto/maildir.html
+// The Maildirs are under maildir_root, laid out by maildir_layout.
+func init() {
+	RegisterBackend("maildir", func() Backend {
+		return &maildirBackend{}
+	})
+}
+
+// The layout when maildir_layout is not set, one Maildir for each user of each domain
+const defaultMaildirLayout = "{domain}/{user}"
+
+type maildirBackend struct {
+	root        string
+	layout      string
+	primaryHost string
+	hostname    string
+	pid         string
+	count       uint64 // makes the file names unique within the process
+}
+
+func (m *maildirBackend) Initialize(config GlobalConfig) error {
+	if config.Maildir_root == "" {
+		return errors.New("maildir_root is not set")
+	}
+	m.root = config.Maildir_root
+	m.layout = config.Maildir_layout
+	m.primaryHost = config.Primary_host
+	if m.layout == "" {
+		m.layout = defaultMaildirLayout
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	// '/' and ':' can't be in the name of a file in a Maildir
+	m.hostname = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(hostname)
+	m.pid = strconv.Itoa(os.Getpid())
+	return os.MkdirAll(m.root, 0700)
+}
+
+// Process delivers a copy for each recipient, the hash of the first copy is returned
+func (m *maildirBackend) Process(e *Envelope) (string, error) {
+	return saveCopies(e, m.primaryHost, func(user, host, to, hash string) error {
+		return m.deliver(e, m.maildirFor(user, host), to, hash)
+	})
+}
+
+// maildirFor is the Maildir of user@host
+func (m *maildirBackend) maildirFor(user string, host string) string {
+	dir := strings.NewReplacer(
+		"{user}", maildirSafe(strings.ToLower(user)),
+		"{domain}", maildirSafe(strings.ToLower(host)),
+	).Replace(m.layout)
+	return filepath.Join(m.root, dir)
+}
+
+// maildirSafe makes an address part safe to use as a directory name
+func maildirSafe(s string) string {
+	s = strings.Replace(s, "/", "_", -1)
+	if s == "" || s[0] == '.' {
+		s = "_" + s
+	}
+	return s
+}
+
+// deliver writes the copy for to into tmp/ of the Maildir dir, then moves it to new/ when
+// it is complete. The file is named after the hash of the copy and has LF line endings.
+func (m *maildirBackend) deliver(e *Envelope, dir string, to string, hash string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	name := strconv.FormatInt(now.Unix(), 10) +
+		".M" + strconv.Itoa(now.Nanosecond()/1000) +
+		"P" + m.pid +
+		"Q" + strconv.FormatUint(atomic.AddUint64(&m.count, 1), 10) +
+		"_" + hash +
+		"." + m.hostname
+	tmp := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = writeLines(w, io.MultiReader(
+		strings.NewReader(deliveryHeaders(e, to)),
+		e.NewReader()), false)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, "new", name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (m *maildirBackend) Shutdown() error {
+	return nil
+}
@@ -0,0 +1,112 @@
+package guerrilla
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestEnvelope is a message from sender@example.org to rcptTo
+func newTestEnvelope(data string, rcptTo ...string) *Envelope {
+	e := &Envelope{
+		RemoteAddress: "127.0.0.1",
+		Helo:          "client.example.org",
+		MailFrom:      "sender@example.org",
+		RcptTo:        rcptTo,
+		ServerName:    "mx.example.com",
+		QueueID:       newID("", "sender@example.org", ""),
+		data:          newSpool("", 1<<20),
+	}
+	e.data.Write([]byte(data))
+	return e
+}
+
+// maildirFiles lists the messages delivered to the Maildir dir
+func maildirFiles(t *testing.T, dir string) []string {
+	fis, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, filepath.Join(dir, "new", fi.Name()))
+	}
+	return names
+}
+
+func TestMaildirRetry(t *testing.T) {
+	root, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	m := &maildirBackend{}
+	if err := m.Initialize(GlobalConfig{Maildir_root: root}); err != nil {
+		t.Fatal(err)
+	}
+	// bob's Maildir can't be made while a file is in the way
+	blocked := filepath.Join(root, "example.com", "bob")
+	os.MkdirAll(filepath.Dir(blocked), 0700)
+	if err := ioutil.WriteFile(blocked, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEnvelope("Subject: hi\r\n\r\nhello\r\n", "alice@example.com", "bob@example.com")
+	if _, err := m.Process(e); err == nil {
+		t.Fatal("Process did not fail")
+	}
+	if len(e.RcptTo) != 1 || e.RcptTo[0] != "bob@example.com" || len(e.Hashes) != 1 {
+		t.Fatalf("left to save: %v %v", e.RcptTo, e.Hashes)
+	}
+	bobHash := e.Hashes[0]
+	os.Remove(blocked)
+	if _, err := m.Process(e); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if files := maildirFiles(t, filepath.Join(root, "example.com", user)); len(files) != 1 {
+			t.Errorf("%s got %d copies", user, len(files))
+		} else if user == "bob" && !strings.Contains(files[0], "_"+bobHash+".") {
+			t.Errorf("bob's copy %s is not named after %s, the hash of the first attempt", files[0], bobHash)
+		}
+	}
+}
+
+func TestMaildirDeliver(t *testing.T) {
+	root, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	m := &maildirBackend{}
+	if err := m.Initialize(GlobalConfig{Maildir_root: root, Primary_host: "primary.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEnvelope("Subject: hi\r\n\r\nhello\r\n", "alice@example.com")
+	hash, err := m.Process(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := maildirFiles(t, filepath.Join(root, "example.com", "alice"))
+	if len(files) != 1 {
+		t.Fatalf("got %d copies", len(files))
+	}
+	if hash != e.QueueID || !strings.Contains(filepath.Base(files[0]), "_"+hash+".") {
+		t.Errorf("%s is not named after the queue id %s", files[0], e.QueueID)
+	}
+	b, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := string(b)
+	if !strings.HasPrefix(message, "Delivered-To: alice@primary.example.com\n") {
+		t.Errorf("Delivered-To: %q", message)
+	}
+	if !strings.Contains(message, " with SMTP id "+hash+"@") {
+		t.Errorf("Received: %q", message)
+	}
+	if strings.Contains(message, "\r") || !strings.HasSuffix(message, "\n\nhello\n") {
+		t.Errorf("line endings: %q", message)
+	}
+}
@@ -0,0 +1,146 @@
+package guerrilla
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The mbox backend appends a copy of each message for each recipient to mbox_file,
+// in the mboxrd format: lines starting with "From ", after any number of '>', get
+// one more '>' so that they can be told apart from the line starting the next message.
+// The file is locked while writing, so that mail readers can use it at the same time.
+// The file is rotated by size or date, see rotation.
+func init() {
+	RegisterBackend("mbox", func() Backend {
+		return &mboxBackend{}
+	})
+}
+
+type mboxBackend struct {
+	mu          sync.Mutex // the save workers take turns
+	path        string
+	primaryHost string
+	rotation    rotation
+	period      string // of the current file
+}
+
+func (m *mboxBackend) Initialize(config GlobalConfig) (err error) {
+	if config.Mbox_file == "" {
+		return errors.New("mbox_file is not set")
+	}
+	m.path = config.Mbox_file
+	m.primaryHost = config.Primary_host
+	if m.rotation, err = newRotation(config); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return err
+	}
+	m.period = m.rotation.period(time.Now())
+	if fi, err := os.Stat(m.path); err == nil {
+		m.period = m.rotation.period(fi.ModTime())
+	}
+	return nil
+}
+
+// Process appends a copy for each recipient, the hash of the first copy is returned
+func (m *mboxBackend) Process(e *Envelope) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return saveCopies(e, m.primaryHost, func(user, host, to, hash string) error {
+		headers := deliveryHeaders(e, to)
+		now := time.Now()
+		if err := m.rotate(now, int64(len(headers))+e.Size()); err != nil {
+			return err
+		}
+		return m.write(e, now, io.MultiReader(strings.NewReader(headers), e.NewReader()))
+	})
+}
+
+// rotate renames the current file if it is from an earlier period or has no room for n more bytes.
+// The renamed file gets the time it was last written to in its name.
+func (m *mboxBackend) rotate(now time.Time, n int64) error {
+	period := m.rotation.period(now)
+	fi, err := os.Stat(m.path)
+	if os.IsNotExist(err) {
+		m.period = period
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if period != m.period || m.rotation.full(fi.Size(), n) {
+		rotated := m.path + "." + fi.ModTime().Format("20060102-150405")
+		for i := 1; ; i++ {
+			if _, err := os.Stat(rotated); os.IsNotExist(err) {
+				break
+			}
+			rotated = m.path + "." + fi.ModTime().Format("20060102-150405") + "-" + strconv.Itoa(i)
+		}
+		if err := os.Rename(m.path, rotated); err != nil {
+			return err
+		}
+	}
+	m.period = period
+	return nil
+}
+
+// write appends one message, read from r, to the file
+func (m *mboxBackend) write(e *Envelope, now time.Time, r io.Reader) error {
+	f, err := os.OpenFile(m.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return err
+	}
+	defer unlockFile(f)
+	w := bufio.NewWriter(f)
+	sender := e.MailFrom
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+	w.WriteString("From " + sender + " " + now.Format("Mon Jan _2 15:04:05 2006") + "\n")
+	if err := writeLines(w, r, true); err != nil {
+		return err
+	}
+	// a blank line ends the message
+	w.WriteString("\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// writeLines writes the lines of the message with LF line endings,
+// escaping the From lines for mboxrd if escapeFrom
+func writeLines(w *bufio.Writer, r io.Reader, escapeFrom bool) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			if escapeFrom && strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+				w.WriteString(">")
+			}
+			w.WriteString(line)
+			w.WriteString("\n")
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (m *mboxBackend) Shutdown() error {
+	return nil
+}
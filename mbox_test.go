@@ -0,0 +1,61 @@
+package guerrilla
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMboxEscapeFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &mboxBackend{}
+	if err := m.Initialize(GlobalConfig{Mbox_file: filepath.Join(dir, "mbox")}); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEnvelope("Subject: hi\r\n\r\nFrom here\r\n>From there\r\n>>From afar\r\nFromage\r\n From\r\n", "alice@example.com")
+	if _, err := m.Process(e); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "mbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox := string(b)
+	if !strings.HasPrefix(mbox, "From sender@example.org ") {
+		t.Errorf("the message starts with %q", strings.SplitN(mbox, "\n", 2)[0])
+	}
+	if want := "\n\n>From here\n>>From there\n>>>From afar\nFromage\n From\n\n"; !strings.HasSuffix(mbox, want) {
+		t.Errorf("got %q, want it to end with %q", mbox, want)
+	}
+}
+
+func TestMboxRotateSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &mboxBackend{}
+	if err := m.Initialize(GlobalConfig{Mbox_file: filepath.Join(dir, "mbox"), Rotate_size: 100}); err != nil {
+		t.Fatal(err)
+	}
+	// the first copy goes over the limit but is written, as the file was empty
+	for i := 0; i < 2; i++ {
+		if _, err := m.Process(newTestEnvelope("Subject: hi\r\n\r\nhello\r\n", "alice@example.com")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name() != "mbox" || !strings.HasPrefix(files[1].Name(), "mbox.") {
+		t.Fatalf("got %d files", len(files))
+	}
+}
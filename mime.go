@@ -0,0 +1,160 @@
+package guerrilla
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// The mime processor parses the MIME structure of the message into e.Parsed,
+// for the steps after it. A message that can't be parsed is still passed on,
+// with as much as could be parsed, or a nil e.Parsed.
+func init() {
+	RegisterProcessor("mime", func() Processor {
+		return &mimeProcessor{}
+	})
+}
+
+// Limits on the MIME structure, the rest of a message past them is not parsed
+const (
+	mimeMaxDepth = 20   // multiparts within multiparts
+	mimeMaxParts = 1000 // parts in the message
+)
+
+// ParsedMessage is the MIME structure of a message, see ParseMessage
+type ParsedMessage struct {
+	ContentType string     `json:"content_type"` // of the message, eg. "multipart/mixed"
+	Charset     string     `json:"charset"`      // of the first text part, lower case. Empty if there is none
+	Parts       []MimePart `json:"parts"`        // the parts that are not multiparts, in order
+}
+
+// MimePart is a part of a message that is not a multipart
+type MimePart struct {
+	ContentType string `json:"content_type"`       // eg. "text/plain"
+	Charset     string `json:"charset,omitempty"`  // lower case, "us-ascii" for text without a charset
+	Filename    string `json:"filename,omitempty"` // decoded
+	Attachment  bool   `json:"attachment"`         // if it has a filename or is sent as an attachment
+	Size        int64  `json:"size"`               // in bytes, decoded
+	Hash        string `json:"hash"`               // the hex SHA-256 of the decoded content
+}
+
+// Attachments returns the parts that are attachments
+func (p *ParsedMessage) Attachments() []MimePart {
+	var attachments []MimePart
+	for _, part := range p.Parts {
+		if part.Attachment {
+			attachments = append(attachments, part)
+		}
+	}
+	return attachments
+}
+
+// ParseMessage reads the MIME structure of the message from r.
+// If an error is returned, the ParsedMessage has what was parsed before it, if anything.
+func ParseMessage(r io.Reader) (*ParsedMessage, error) {
+	msg, err := mail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	header := textproto.MIMEHeader(msg.Header)
+	p := &ParsedMessage{}
+	p.ContentType, _ = mimeContentType(header)
+	return p, p.walk(header, msg.Body, 0)
+}
+
+// mimeContentType returns the media type and parameters of a part,
+// text/plain if it has none
+func mimeContentType(header textproto.MIMEHeader) (string, map[string]string) {
+	mediaType, params, err := parseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType == "" {
+		return "text/plain", map[string]string{}
+	}
+	return mediaType, params
+}
+
+// walk adds the part with header and body to p.Parts, or the parts in it if it is a multipart
+func (p *ParsedMessage) walk(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	mediaType, params := mimeContentType(header)
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		if depth >= mimeMaxDepth {
+			return errors.New("MIME parts nested too deep")
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if len(p.Parts) >= mimeMaxParts {
+				return errors.New("Too many MIME parts")
+			}
+			if err := p.walk(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	part := MimePart{ContentType: mediaType, Charset: strings.ToLower(params["charset"])}
+	if strings.HasPrefix(mediaType, "text/") {
+		if part.Charset == "" {
+			part.Charset = "us-ascii"
+		}
+		if p.Charset == "" {
+			p.Charset = part.Charset
+		}
+	}
+	disposition, dparams, _ := parseMediaType(header.Get("Content-Disposition"))
+	part.Filename = dparams["filename"]
+	if part.Filename == "" {
+		part.Filename = params["name"]
+	}
+	part.Attachment = disposition == "attachment" || part.Filename != ""
+	h := sha256.New()
+	size, err := io.Copy(h, mimeTransferDecoder(header.Get("Content-Transfer-Encoding"), body))
+	part.Size = size
+	part.Hash = hex.EncodeToString(h.Sum(nil))
+	p.Parts = append(p.Parts, part)
+	return err
+}
+
+// mimeTransferDecoder decodes body as sent with the Content-Transfer-Encoding encoding
+func mimeTransferDecoder(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// the decoder skips the line breaks
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+type mimeProcessor struct{}
+
+func (m *mimeProcessor) Initialize(config GlobalConfig) error {
+	return nil
+}
+
+func (m *mimeProcessor) Process(e *Envelope, next ProcessFunc) (string, error) {
+	parsed, err := ParseMessage(e.NewReader())
+	if err != nil {
+		log.Printf("mime: %v", err)
+	}
+	e.Parsed = parsed
+	return next(e)
+}
+
+func (m *mimeProcessor) Shutdown() error {
+	return nil
+}
@@ -0,0 +1,148 @@
+package guerrilla
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		name        string
+		message     string
+		contentType string
+		charset     string
+		parts       []MimePart // without the hashes
+	}{
+		{
+			name:        "no content type",
+			message:     "Subject: hi\r\n\r\nhello\r\n",
+			contentType: "text/plain",
+			charset:     "us-ascii",
+			parts:       []MimePart{{ContentType: "text/plain", Charset: "us-ascii", Size: 7}},
+		},
+		{
+			name: "folded content type",
+			message: "Content-Type: text/html;\r\n" +
+				"\tcharset=\"ISO-8859-1\"\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+				"caf=E9\r\n",
+			contentType: "text/html",
+			charset:     "iso-8859-1",
+			parts:       []MimePart{{ContentType: "text/html", Charset: "iso-8859-1", Size: 6}},
+		},
+		{
+			name: "nested multipart",
+			message: "Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+				"--outer\r\n" +
+				"Content-Type: multipart/alternative; boundary=\"inner\"\r\n\r\n" +
+				"--inner\r\n" +
+				"Content-Type: text/plain; charset=windows-1252\r\n\r\n" +
+				"hello\r\n" +
+				"--inner\r\n" +
+				"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+				"<p>hello</p>\r\n" +
+				"--inner--\r\n" +
+				"--outer\r\n" +
+				"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+				"Content-Transfer-Encoding: base64\r\n\r\n" +
+				"aGVs\r\nbG8=\r\n" +
+				"--outer--\r\n",
+			contentType: "multipart/mixed",
+			charset:     "windows-1252",
+			parts: []MimePart{
+				{ContentType: "text/plain", Charset: "windows-1252", Size: 5},
+				{ContentType: "text/html", Charset: "utf-8", Size: 12},
+				{ContentType: "application/pdf", Filename: "report.pdf", Attachment: true, Size: 5},
+			},
+		},
+		{
+			name: "RFC 2231 filename",
+			message: "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\n" +
+				"Content-Type: application/octet-stream\r\n" +
+				"Content-Disposition: attachment;\r\n" +
+				" filename*0*=iso-8859-1''%E9t;\r\n" +
+				" filename*1*=%E9.pdf\r\n\r\n" +
+				"hello\r\n" +
+				"--b--\r\n",
+			contentType: "multipart/mixed",
+			parts:       []MimePart{{ContentType: "application/octet-stream", Filename: "été.pdf", Attachment: true, Size: 5}},
+		},
+		{
+			name: "encoded word filename",
+			message: "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\n" +
+				"Content-Type: image/png\r\n" +
+				"Content-Disposition: inline; filename=\"=?UTF-8?B?w6l0w6kucG5n?=\"\r\n\r\n" +
+				"hello\r\n" +
+				"--b--\r\n",
+			contentType: "multipart/mixed",
+			parts:       []MimePart{{ContentType: "image/png", Filename: "été.png", Attachment: true, Size: 5}},
+		},
+		{
+			name: "attachment without a name",
+			message: "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\n" +
+				"Content-Type: text/calendar\r\n" +
+				"Content-Disposition: attachment\r\n\r\n" +
+				"hello\r\n" +
+				"--b--\r\n",
+			contentType: "multipart/mixed",
+			charset:     "us-ascii",
+			parts:       []MimePart{{ContentType: "text/calendar", Charset: "us-ascii", Attachment: true, Size: 5}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := ParseMessage(strings.NewReader(test.message))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.ContentType != test.contentType || p.Charset != test.charset {
+				t.Errorf("got %s %q, want %s %q", p.ContentType, p.Charset, test.contentType, test.charset)
+			}
+			if len(p.Parts) != len(test.parts) {
+				t.Fatalf("got %d parts, want %d", len(p.Parts), len(test.parts))
+			}
+			for i, part := range p.Parts {
+				if len(part.Hash) != 64 {
+					t.Errorf("part %d: hash %q", i, part.Hash)
+				}
+				part.Hash = ""
+				if part != test.parts[i] {
+					t.Errorf("part %d: got %+v, want %+v", i, part, test.parts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseMessageHash(t *testing.T) {
+	p, err := ParseMessage(strings.NewReader("Content-Transfer-Encoding: base64\r\n\r\naGVsbG8=\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// of the decoded content
+	sum := sha256.Sum256([]byte("hello"))
+	if p.Parts[0].Hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("hash %s", p.Parts[0].Hash)
+	}
+}
+
+func TestParseMessageDepth(t *testing.T) {
+	var message strings.Builder
+	for i := 0; i <= mimeMaxDepth; i++ {
+		message.WriteString("Content-Type: multipart/mixed; boundary=b" + strings.Repeat("x", i) + "\r\n\r\n")
+		message.WriteString("--b" + strings.Repeat("x", i) + "\r\n")
+	}
+	message.WriteString("\r\nhello\r\n")
+	p, err := ParseMessage(strings.NewReader(message.String()))
+	if err == nil {
+		t.Fatal("parsed parts nested too deep")
+	}
+	if p == nil || p.ContentType != "multipart/mixed" {
+		t.Errorf("got %+v", p)
+	}
+}
@@ -0,0 +1,211 @@
+package guerrilla
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Processor is a step of saving the mail, in a chain configured by save_process,
+// eg. "headers|hash|compress|redis|sql". Each step can change the envelope for the steps
+// after it, eg. adding to e.Values, and passes it on by calling next.
+// Process is called by several save workers at the same time, so it must be safe for concurrent use.
+type Processor interface {
+	// Initialize is called once, before the first call to Process
+	Initialize(config GlobalConfig) error
+	// Process does the step, then calls next and returns what it returned.
+	// To stop the chain, it returns without calling next, eg. with an SMTPError to reject the message.
+	Process(e *Envelope, next ProcessFunc) (queueID string, err error)
+	// Shutdown releases any resources once the workers stopped calling Process
+	Shutdown() error
+}
+
+// ProcessFunc is the rest of a chain
+type ProcessFunc func(e *Envelope) (queueID string, err error)
+
+var processorsMu sync.Mutex
+var processors = make(map[string]func() Processor)
+
+// RegisterProcessor adds a step that save_process can name, like the processors
+// registered by init below. If a backend has the same name, the processor is the one
+// used, even at the end of the chain. Panics if name is already a processor.
+func RegisterProcessor(name string, factory func() Processor) {
+	processorsMu.Lock()
+	defer processorsMu.Unlock()
+	if _, dup := processors[name]; dup {
+		panic("guerrilla: RegisterProcessor called twice for " + name)
+	}
+	processors[name] = factory
+}
+
+func init() {
+	RegisterProcessor("headers", func() Processor {
+		return &headersProcessor{}
+	})
+	RegisterProcessor("hash", func() Processor {
+		return &hashProcessor{}
+	})
+	RegisterProcessor("compress", func() Processor {
+		return &compressProcessor{}
+	})
+}
+
+// chain is a Backend made of processors, separated by '|' in process.
+// The last name can be a backend, which saves the mail at the end of the chain.
+type chain struct {
+	process    string
+	processors []Processor
+	backend    Backend // nil if the chain ends with a processor
+	first      ProcessFunc
+}
+
+func newChain(process string) *chain {
+	return &chain{process: process}
+}
+
+func (c *chain) Initialize(config GlobalConfig) error {
+	names := strings.Split(c.process, "|")
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		processorsMu.Lock()
+		factory, ok := processors[name]
+		processorsMu.Unlock()
+		if ok {
+			p := factory()
+			if err := p.Initialize(config); err != nil {
+				c.Shutdown()
+				return err
+			}
+			c.processors = append(c.processors, p)
+			continue
+		}
+		if i < len(names)-1 {
+			c.Shutdown()
+			return errors.New("Unknown processor: " + name)
+		}
+		b, err := newBackend(name, config)
+		if err != nil {
+			c.Shutdown()
+			return err
+		}
+		c.backend = b
+	}
+	c.first = chainEnd
+	if c.backend != nil {
+		c.first = c.backend.Process
+	}
+	for i := len(c.processors) - 1; i >= 0; i-- {
+		p, next := c.processors[i], c.first
+		c.first = func(e *Envelope) (string, error) {
+			return p.Process(e, next)
+		}
+	}
+	return nil
+}
+
+// Process passes e down the chain, without what processors set on an earlier attempt
+// but the hashes, so that a copy is saved by the same key when it is tried again
+func (c *chain) Process(e *Envelope) (string, error) {
+	e.DeliveryHeader = ""
+	e.Parsed = nil
+	e.Values = make(map[string]interface{})
+	return c.first(e)
+}
+
+func (c *chain) Shutdown() error {
+	var err error
+	for _, p := range c.processors {
+		if perr := p.Shutdown(); err == nil {
+			err = perr
+		}
+	}
+	if c.backend != nil {
+		if berr := c.backend.Shutdown(); err == nil {
+			err = berr
+		}
+	}
+	return err
+}
+
+// chainEnd ends a chain without a backend
+func chainEnd(e *Envelope) (string, error) {
+	return envelopeID(e), nil
+}
+
+// primaryAddress returns the address a copy for rcpt is saved for, see deliveredTo,
+// and rcpt as given in RCPT TO
+func primaryAddress(rcpt string, primaryHost string) (to string, recipient string, err error) {
+	user, host, err := extractEmail(rcpt)
+	if err != nil {
+		return "", "", err
+	}
+	return deliveredTo(user, host, primaryHost), user + "@" + host, nil
+}
+
+// headersProcessor sets e.DeliveryHeader to the Received header
+type headersProcessor struct{}
+
+func (h *headersProcessor) Initialize(config GlobalConfig) error {
+	return nil
+}
+
+func (h *headersProcessor) Process(e *Envelope, next ProcessFunc) (string, error) {
+	e.DeliveryHeader = receivedHeader(e)
+	return next(e)
+}
+
+func (h *headersProcessor) Shutdown() error {
+	return nil
+}
+
+// hashProcessor sets e.Hashes, the hash of each copy of the message, see copyHashes
+type hashProcessor struct {
+	primaryHost string
+}
+
+func (h *hashProcessor) Initialize(config GlobalConfig) error {
+	h.primaryHost = config.Primary_host
+	return nil
+}
+
+func (h *hashProcessor) Process(e *Envelope, next ProcessFunc) (string, error) {
+	if err := copyHashes(e, h.primaryHost); err != nil {
+		return "", err
+	}
+	return next(e)
+}
+
+func (h *hashProcessor) Shutdown() error {
+	return nil
+}
+
+// compressProcessor sets e.Values["compressed"], a []string with each copy of the message
+// compressed, with its Delivered-To header and e.DeliveryHeader
+type compressProcessor struct {
+	primaryHost string
+}
+
+func (c *compressProcessor) Initialize(config GlobalConfig) error {
+	c.primaryHost = config.Primary_host
+	return nil
+}
+
+func (c *compressProcessor) Process(e *Envelope, next ProcessFunc) (string, error) {
+	compressed := make([]string, len(e.RcptTo))
+	for i, rcpt := range e.RcptTo {
+		to, _, err := primaryAddress(rcpt, c.primaryHost)
+		if err != nil {
+			return "", err
+		}
+		header := "Delivered-To: " + to + "\r\n" + e.DeliveryHeader
+		if compressed[i], err = compress(strings.NewReader(header), e.NewReader()); err != nil {
+			return "", err
+		}
+	}
+	e.Values["compressed"] = compressed
+	return next(e)
+}
+
+func (c *compressProcessor) Shutdown() error {
+	return nil
+}
@@ -0,0 +1,185 @@
+package guerrilla
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// diskQueue is a write-ahead queue of the accepted messages, so that a client can be told
+// "queued as" as soon as its message is on disk instead of waiting for the backend.
+// Each message is a pair of files in dir: <id>.data with the DATA and <id>.json with the
+// envelope. The .json is written last, a message without one was never acknowledged.
+// Both files are removed once the backend saved the message,
+// or moved to deadDir if it could not be saved.
+type diskQueue struct {
+	dir     string
+	deadDir string
+}
+
+// queueEntry is what is written to the .json file
+type queueEntry struct {
+	ID       string
+	Envelope *Envelope
+	Attempts int // failed saves so far
+}
+
+func openDiskQueue(dir string, deadDir string) (*diskQueue, error) {
+	if deadDir == "" {
+		deadDir = filepath.Join(dir, "dead")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(deadDir, 0700); err != nil {
+		return nil, err
+	}
+	return &diskQueue{dir: dir, deadDir: deadDir}, nil
+}
+
+func (q *diskQueue) path(id, ext string) string {
+	return filepath.Join(q.dir, id+ext)
+}
+
+// put writes the envelope and its data to disk and syncs them, named by the queue id of e.
+// The returned entry has the envelope reading its data from the queue.
+func (q *diskQueue) put(e *Envelope) (*queueEntry, error) {
+	id := envelopeID(e)
+	data, err := os.OpenFile(q.path(id, ".data"), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(data, e.NewReader())
+	if err == nil {
+		err = data.Sync()
+	}
+	if err != nil {
+		data.Close()
+		os.Remove(data.Name())
+		return nil, err
+	}
+	queued := *e
+	queued.data = &spool{file: data, size: size}
+	entry := &queueEntry{ID: id, Envelope: &queued}
+	if err := q.writeEntry(entry); err != nil {
+		queued.data.Reset()
+		return nil, err
+	}
+	return entry, nil
+}
+
+// writeEntry writes the .json file with a rename, so that it is either complete or not there
+func (q *diskQueue) writeEntry(entry *queueEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp := q.path(entry.ID, ".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, q.path(entry.ID, ".json"))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return q.syncDir()
+}
+
+// syncDir makes the new names in the directory durable
+func (q *diskQueue) syncDir() error {
+	d, err := os.Open(q.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// remove deletes a saved message from the queue
+func (q *diskQueue) remove(entry *queueEntry) {
+	if err := os.Remove(q.path(entry.ID, ".json")); err != nil {
+		log.Printf("queue: %v", err)
+	}
+	entry.Envelope.data.Reset()
+}
+
+// deadLetter moves a message that could not be saved out of the queue, to deadDir
+func (q *diskQueue) deadLetter(entry *queueEntry) error {
+	entry.Envelope.data.file.Close()
+	entry.Envelope.data.file = nil
+	for _, ext := range []string{".data", ".json"} {
+		if err := os.Rename(q.path(entry.ID, ext), filepath.Join(q.deadDir, entry.ID+ext)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load reads the messages that were queued but not saved yet, eg. before a restart.
+// Left over files of messages that were never acknowledged are removed.
+func (q *diskQueue) load() ([]*queueEntry, error) {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*queueEntry
+	committed := make(map[string]bool)
+	for _, fi := range files {
+		if id := strings.TrimSuffix(fi.Name(), ".json"); id != fi.Name() {
+			committed[id] = true
+			entry, err := q.loadEntry(id)
+			if err != nil {
+				log.Printf("queue: cannot load %s: %v", fi.Name(), err)
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if ext := filepath.Ext(name); (ext == ".data" || ext == ".tmp") && !committed[strings.TrimSuffix(name, ext)] {
+			os.Remove(filepath.Join(q.dir, name))
+		}
+	}
+	return entries, nil
+}
+
+func (q *diskQueue) loadEntry(id string) (*queueEntry, error) {
+	b, err := ioutil.ReadFile(q.path(id, ".json"))
+	if err != nil {
+		return nil, err
+	}
+	entry := &queueEntry{}
+	if err := json.Unmarshal(b, entry); err != nil {
+		return nil, err
+	}
+	if entry.Envelope == nil || entry.ID != id {
+		return nil, os.ErrInvalid
+	}
+	data, err := os.OpenFile(q.path(id, ".data"), os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := data.Stat()
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	entry.Envelope.data = &spool{file: data, size: fi.Size()}
+	return entry, nil
+}
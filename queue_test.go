@@ -0,0 +1,171 @@
+package guerrilla
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingBackend fails every save with a temporary error
+type failingBackend struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (f *failingBackend) Initialize(config GlobalConfig) error {
+	return nil
+}
+
+func (f *failingBackend) Process(e *Envelope) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	return "", errors.New("Backend is down")
+}
+
+func (f *failingBackend) Shutdown() error {
+	return nil
+}
+
+// waitFor polls cond until it is true, failing the test if it takes too long
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for start := time.Now(); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("still waiting for %s", what)
+		}
+	}
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func TestQueueReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := openDiskQueue(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := q.put(newTestEnvelope("Subject: hi\r\n\r\nhello\r\n", "alice@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the program stops before the message is saved, while another one was being queued
+	entry.Envelope.data.file.Close()
+	for _, name := range []string{"unacked.data", "unacked.tmp"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("partial"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backend := &memoryBackend{}
+	workers := NewSaveWorkers(backend, 1)
+	defer workers.Stop()
+	if err := workers.OpenQueue(dir, "", RetryPolicy{Max_attempts: 1}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the queued message", func() bool { return len(backend.saved()) == 1 })
+	saved := backend.saved()[0]
+	if saved.QueueID != entry.ID || len(saved.RcptTo) != 1 || saved.RcptTo[0] != "alice@example.com" {
+		t.Errorf("replayed %+v", saved)
+	}
+	if message := backend.savedMessages()[0]; message != "Subject: hi\r\n\r\nhello\r\n" {
+		t.Errorf("replayed %q", message)
+	}
+	waitFor(t, "the queue to be emptied", func() bool { return !exists(q.path(entry.ID, ".json")) })
+	for _, name := range []string{"unacked.data", "unacked.tmp"} {
+		if exists(filepath.Join(dir, name)) {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+}
+
+func TestQueueWriteEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := openDiskQueue(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := q.put(newTestEnvelope("Subject: hi\r\n\r\nhello\r\n", "alice@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entry.Envelope.data.Reset()
+	entry.Attempts = 2
+	if err := q.writeEntry(entry); err != nil {
+		t.Fatal(err)
+	}
+	if exists(q.path(entry.ID, ".tmp")) {
+		t.Error("the .tmp file was left behind")
+	}
+	// the rename can't happen, the .json written before has to stay as it was
+	if err := os.Mkdir(q.path(entry.ID, ".tmp"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	entry.Attempts = 3
+	if err := q.writeEntry(entry); err == nil {
+		t.Fatal("writeEntry did not fail")
+	}
+	loaded, err := q.loadEntry(entry.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Envelope.data.file.Close()
+	if loaded.Attempts != 2 || loaded.Envelope.RcptTo[0] != "alice@example.com" {
+		t.Errorf("loaded %+v", loaded)
+	}
+}
+
+func TestQueueDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	deadDir := filepath.Join(dir, "dead letters")
+	backend := &failingBackend{}
+	workers := NewSaveWorkers(backend, 1)
+	defer workers.Stop()
+	workers.SetBreaker(100, time.Second)
+	if err := workers.OpenQueue(dir, deadDir, RetryPolicy{Max_attempts: 3, Backoff: 1, Max_backoff: 1}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := workers.enqueue(newTestEnvelope("Subject: hi\r\n\r\nhello\r\n", "alice@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := &diskQueue{dir: deadDir}
+	waitFor(t, "the dead letter", func() bool { return exists(dead.path(id, ".json")) })
+	for _, ext := range []string{".data", ".json"} {
+		if exists(filepath.Join(dir, id+ext)) {
+			t.Errorf("%s%s is still in the queue", id, ext)
+		}
+	}
+	entry, err := dead.loadEntry(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entry.Envelope.data.file.Close()
+	backend.mu.Lock()
+	calls := backend.calls
+	backend.mu.Unlock()
+	if calls != 3 {
+		t.Errorf("tried %d times, want 3", calls)
+	}
+	if message, _ := ioutil.ReadAll(entry.Envelope.NewReader()); string(message) != "Subject: hi\r\n\r\nhello\r\n" {
+		t.Errorf("dead letter %q", message)
+	}
+}
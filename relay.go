@@ -0,0 +1,444 @@
+package guerrilla
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The relay backend hands each message on to the next hop at relay_addr, an MTA over SMTP
+// or eg. Dovecot over LMTP, a host:port or the path of a unix socket.
+// The connection is upgraded with STARTTLS when the next hop offers it, see relay_tls,
+// and authenticated with AUTH PLAIN when relay_username is set.
+// The next hop answers for each recipient: when some recipients were refused, the
+// save fails with the refusal, a temporary one first. The recipients that were
+// delivered are taken out of the envelope, so that the message is only tried again
+// for the others. A client can't be told that only some recipients got its message,
+// so the backend needs the queue: the client is replied once the message is on disk.
+func init() {
+	RegisterBackend("relay", func() Backend {
+		return &relayBackend{}
+	})
+}
+
+// The relay_tls settings
+const (
+	relayTlsOpportunistic = "opportunistic" // STARTTLS if the next hop offers it, the default
+	relayTlsRequired      = "required"      // STARTTLS or fail
+	relayTlsImplicit      = "implicit"      // connect with TLS, eg. to port 465
+	relayTlsNone          = "none"
+)
+
+type relayBackend struct {
+	addr      string
+	lmtp      bool
+	tlsMode   string
+	tlsConfig *tls.Config
+	username  string
+	password  string
+	helo      string
+	timeout   time.Duration
+}
+
+func (r *relayBackend) Initialize(config GlobalConfig) error {
+	if config.Relay_addr == "" {
+		return errors.New("relay_addr is not set")
+	}
+	if config.Queue_dir == "" {
+		return errors.New("The relay backend needs queue_dir, a message may be delivered to some recipients only")
+	}
+	r.addr = config.Relay_addr
+	switch strings.ToLower(config.Relay_protocol) {
+	case "", "smtp":
+	case "lmtp":
+		r.lmtp = true
+	default:
+		return errors.New("relay_protocol must be smtp or lmtp")
+	}
+	r.tlsMode = strings.ToLower(config.Relay_tls)
+	switch r.tlsMode {
+	case "":
+		r.tlsMode = relayTlsOpportunistic
+	case relayTlsOpportunistic, relayTlsRequired, relayTlsImplicit, relayTlsNone:
+	default:
+		return errors.New("relay_tls must be opportunistic, required, implicit or none")
+	}
+	serverName, _, err := net.SplitHostPort(r.addr)
+	if err != nil {
+		// a unix socket
+		serverName = "localhost"
+	}
+	r.tlsConfig = &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: config.Relay_tls_skip_verify,
+	}
+	r.username = config.Relay_username
+	r.password = config.Relay_password
+	r.helo = config.Relay_helo
+	if r.helo == "" {
+		if r.helo, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+	timeout := config.Relay_timeout
+	if timeout == 0 {
+		timeout = 60
+	}
+	r.timeout = time.Duration(timeout) * time.Second
+	return nil
+}
+
+// Process relays the message, the id in its Received header is returned
+func (r *relayBackend) Process(e *Envelope) (string, error) {
+	hash := envelopeID(e)
+	c, err := r.dial(e.Deadline)
+	if err != nil {
+		return "", fmt.Errorf("relay: %v", err)
+	}
+	defer c.close()
+	refused, err := c.send(e, receivedHeader(e))
+	if err != nil {
+		return "", err
+	}
+	return hash, relayOutcome(e, refused)
+}
+
+func (r *relayBackend) Shutdown() error {
+	return nil
+}
+
+// relayOutcome takes the delivered recipients out of the envelope. The error is the reply
+// of a recipient that was refused, temporarily if any was, so that the message is tried again.
+// The refused recipients are left in the envelope, those refused permanently end up in the
+// dead letters with the message.
+func relayOutcome(e *Envelope, refused map[string]*textproto.Error) error {
+	if len(refused) == 0 {
+		return nil
+	}
+	var temporary, permanent *textproto.Error
+	var left []string
+	for _, rcpt := range e.RcptTo {
+		reply, ok := refused[rcpt]
+		if !ok {
+			continue
+		}
+		log.Printf("relay: %s refused: %d %s", rcpt, reply.Code, reply.Msg)
+		left = append(left, rcpt)
+		if reply.Code >= 500 {
+			if permanent == nil {
+				permanent = reply
+			}
+		} else if temporary == nil {
+			temporary = reply
+		}
+	}
+	e.RcptTo = left
+	reply := temporary
+	if reply == nil {
+		reply = permanent
+	}
+	return &SMTPError{reply.Code, strings.Replace(reply.Msg, "\n", " ", -1)}
+}
+
+// relayConn is a connection to the next hop
+type relayConn struct {
+	r        *relayBackend
+	conn     net.Conn
+	text     *textproto.Conn
+	ext      map[string]string // the extensions in the EHLO / LHLO reply, by upper case keyword
+	tls      bool
+	deadline time.Time // of the envelope, see Envelope.Deadline
+}
+
+// dial connects to the next hop, giving up at deadline if it is not zero
+func (r *relayBackend) dial(deadline time.Time) (*relayConn, error) {
+	network := "tcp"
+	if strings.HasPrefix(r.addr, "/") {
+		network = "unix"
+	}
+	dialer := &net.Dialer{Timeout: r.timeout, Deadline: deadline}
+	var conn net.Conn
+	var err error
+	if r.tlsMode == relayTlsImplicit {
+		conn, err = tls.DialWithDialer(dialer, network, r.addr, r.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(network, r.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &relayConn{r: r, tls: r.tlsMode == relayTlsImplicit, deadline: deadline}
+	c.setConn(conn)
+	if err := c.hello(); err != nil {
+		c.text.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *relayConn) setConn(conn net.Conn) {
+	c.conn = conn
+	c.text = textproto.NewConn(conn)
+}
+
+// setDeadline gives the next step relay_timeout, but not past the envelope's deadline
+func (c *relayConn) setDeadline() {
+	deadline := time.Now().Add(c.r.timeout)
+	if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+		deadline = c.deadline
+	}
+	c.conn.SetDeadline(deadline)
+}
+
+// cmd sends a command and reads the reply, an error if its code does not start with expect
+func (c *relayConn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	c.setDeadline()
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadResponse(expect)
+}
+
+// hello reads the greeting, says EHLO or LHLO, then starts TLS and authenticates as configured
+func (c *relayConn) hello() error {
+	c.setDeadline()
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		return err
+	}
+	if err := c.ehlo(); err != nil {
+		return err
+	}
+	if !c.tls && c.r.tlsMode != relayTlsNone {
+		if _, ok := c.ext["STARTTLS"]; ok {
+			if _, _, err := c.cmd(220, "STARTTLS"); err != nil {
+				return err
+			}
+			tlsConn := tls.Client(c.conn, c.r.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return err
+			}
+			c.setConn(tlsConn)
+			c.tls = true
+			if err := c.ehlo(); err != nil {
+				return err
+			}
+		} else if c.r.tlsMode == relayTlsRequired {
+			return errors.New("the next hop does not offer STARTTLS")
+		}
+	}
+	if c.r.username == "" {
+		return nil
+	}
+	if !c.tls {
+		return errors.New("not sending the password without TLS")
+	}
+	if !strings.Contains(" "+c.ext["AUTH"]+" ", " PLAIN ") {
+		return errors.New("the next hop does not offer AUTH PLAIN")
+	}
+	resp := base64.StdEncoding.EncodeToString([]byte("\x00" + c.r.username + "\x00" + c.r.password))
+	_, _, err := c.cmd(235, "AUTH PLAIN %s", resp)
+	return err
+}
+
+// ehlo says EHLO, or LHLO for LMTP, and reads the extensions.
+// An SMTP server that does not know EHLO is greeted with HELO.
+func (c *relayConn) ehlo() error {
+	verb := "EHLO"
+	if c.r.lmtp {
+		verb = "LHLO"
+	}
+	_, msg, err := c.cmd(250, "%s %s", verb, c.r.helo)
+	if err != nil {
+		if _, ok := err.(*textproto.Error); !ok || c.r.lmtp {
+			return err
+		}
+		c.ext = nil
+		_, _, err = c.cmd(250, "HELO %s", c.r.helo)
+		return err
+	}
+	c.ext = make(map[string]string)
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		args := strings.SplitN(line, " ", 2)
+		if len(args) > 1 {
+			c.ext[strings.ToUpper(args[0])] = args[1]
+		} else {
+			c.ext[strings.ToUpper(args[0])] = ""
+		}
+	}
+	return nil
+}
+
+// send sends the message with header added before it.
+// The recipients refused by the next hop are returned with its reply.
+// An error is returned when the message could not be sent at all.
+func (c *relayConn) send(e *Envelope, header string) (map[string]*textproto.Error, error) {
+	if err := c.checkBody(e); err != nil {
+		return nil, err
+	}
+	if _, _, err := c.cmd(250, "MAIL FROM:<%s>%s", e.MailFrom, c.mailParams(e, int64(len(header)))); err != nil {
+		return nil, relayError(err)
+	}
+	refused := make(map[string]*textproto.Error)
+	var accepted []string
+	for _, rcpt := range e.RcptTo {
+		_, _, err := c.cmd(25, "RCPT TO:<%s>", rcpt)
+		if err == nil {
+			accepted = append(accepted, rcpt)
+			continue
+		}
+		reply, ok := err.(*textproto.Error)
+		if !ok {
+			return nil, relayError(err)
+		}
+		refused[rcpt] = reply
+	}
+	if len(accepted) == 0 {
+		c.cmd(250, "RSET")
+		return refused, nil
+	}
+	message := io.MultiReader(strings.NewReader(header), e.NewReader())
+	var err error
+	if strings.ToUpper(e.MailParams["BODY"]) == "BINARYMIME" {
+		err = c.bdat(message, int64(len(header))+e.Size())
+	} else {
+		err = c.data(message)
+	}
+	if err != nil {
+		return nil, relayError(err)
+	}
+	// SMTP replies once for the message, LMTP once for each accepted recipient
+	replies := 1
+	if c.r.lmtp {
+		replies = len(accepted)
+	}
+	for i := 0; i < replies; i++ {
+		c.setDeadline()
+		_, _, err := c.text.ReadResponse(250)
+		if err == nil {
+			continue
+		}
+		reply, ok := err.(*textproto.Error)
+		if !ok {
+			return nil, relayError(err)
+		}
+		if c.r.lmtp {
+			refused[accepted[i]] = reply
+			continue
+		}
+		for _, rcpt := range accepted {
+			refused[rcpt] = reply
+		}
+	}
+	return refused, nil
+}
+
+// data sends the message after DATA, dot-stuffed
+func (c *relayConn) data(message io.Reader) error {
+	if _, _, err := c.cmd(354, "DATA"); err != nil {
+		return err
+	}
+	c.setDeadline()
+	w := c.text.DotWriter()
+	_, err := io.Copy(w, message)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// bdat sends the message of size bytes as it is, in one chunk, see RFC 3030.
+// The reply is read by the caller, as after the DATA.
+func (c *relayConn) bdat(message io.Reader, size int64) error {
+	c.setDeadline()
+	if err := c.text.PrintfLine("BDAT %d LAST", size); err != nil {
+		return err
+	}
+	if _, err := io.Copy(c.text.W, message); err != nil {
+		return err
+	}
+	return c.text.W.Flush()
+}
+
+// checkBody makes sure the next hop can take the message as it is, the message is not converted.
+// A BINARYMIME message needs CHUNKING and BINARYMIME, an 8BITMIME one with 8-bit content needs
+// 8BITMIME, RFC 3030 and RFC 6152. Otherwise it is a temporary failure, the next hop may be
+// changed to one that can take it.
+func (c *relayConn) checkBody(e *Envelope) error {
+	switch strings.ToUpper(e.MailParams["BODY"]) {
+	case "BINARYMIME":
+		_, chunking := c.ext["CHUNKING"]
+		_, binary := c.ext["BINARYMIME"]
+		if !chunking || !binary {
+			return errors.New("relay: the next hop does not offer CHUNKING and BINARYMIME for a BINARYMIME message")
+		}
+	case "8BITMIME":
+		if _, ok := c.ext["8BITMIME"]; !ok && !is7bit(e.NewReader()) {
+			return errors.New("relay: the next hop does not offer 8BITMIME for an 8-bit message")
+		}
+	}
+	return nil
+}
+
+// is7bit tells if r has only 7-bit bytes
+func is7bit(r io.Reader) bool {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			if b >= 0x80 {
+				return false
+			}
+		}
+		if err != nil {
+			return true
+		}
+	}
+}
+
+// mailParams are the ESMTP parameters of MAIL FROM the next hop knows,
+// extra is the size of the header added to the message. See checkBody for BODY.
+func (c *relayConn) mailParams(e *Envelope, extra int64) string {
+	params := ""
+	if _, ok := c.ext["SIZE"]; ok {
+		params += " SIZE=" + strconv.FormatInt(e.Size()+extra, 10)
+	}
+	if body, ok := e.MailParams["BODY"]; ok {
+		_, mime8 := c.ext["8BITMIME"]
+		if mime8 || strings.ToUpper(body) == "BINARYMIME" {
+			params += " BODY=" + body
+		}
+	}
+	if _, ok := e.MailParams["SMTPUTF8"]; ok {
+		if _, ok := c.ext["SMTPUTF8"]; ok {
+			params += " SMTPUTF8"
+		}
+	}
+	return params
+}
+
+// relayError is the reply for the client when the message could not be sent:
+// a 5xx reply of the next hop is passed on, anything else is a temporary failure
+func relayError(err error) error {
+	if reply, ok := err.(*textproto.Error); ok && reply.Code >= 500 {
+		return &SMTPError{reply.Code, strings.Replace(reply.Msg, "\n", " ", -1)}
+	}
+	return fmt.Errorf("relay: %v", err)
+}
+
+func (c *relayConn) close() {
+	c.cmd(221, "QUIT")
+	c.text.Close()
+}
@@ -0,0 +1,128 @@
+package guerrilla
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestRelay returns a relay backend for the next hop at addr, without TLS
+func newTestRelay(t *testing.T, addr string) Backend {
+	b, err := NewBackend(GlobalConfig{
+		Backend_name: "relay",
+		Relay_addr:   addr,
+		Relay_tls:    relayTlsNone,
+		Relay_helo:   "relay.example.org",
+		Queue_dir:    "queue", // only checked to be set
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRelayBinary(t *testing.T) {
+	_, addr, next := startTestServer(t, ServerConfig{})
+	b := newTestRelay(t, addr)
+	// not dot-stuffed, bare CR and LF are kept
+	message := "Subject: bin\r\n\r\n.\r\n\x00\xff\rbare\nend"
+	e := newTestEnvelope(message, "alice@example.com")
+	e.MailParams = map[string]string{"BODY": "BINARYMIME"}
+	if _, err := b.Process(e); err != nil {
+		t.Fatal(err)
+	}
+	saved := next.savedMessages()
+	if len(saved) != 1 || !strings.HasPrefix(saved[0], "Received: ") || !strings.HasSuffix(saved[0], "\r\n"+message) {
+		t.Fatalf("the next hop got %q", saved)
+	}
+}
+
+// startTestHop is a next hop that offers no extensions, it returns the commands it got after EHLO
+func startTestHop(t *testing.T) (string, func() []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var mu sync.Mutex
+	var commands []string
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 hop.example.com\r\n"))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+			case "EHLO":
+				conn.Write([]byte("250 hop.example.com\r\n"))
+			case "QUIT":
+				conn.Write([]byte("221 Bye\r\n"))
+				return
+			default:
+				mu.Lock()
+				commands = append(commands, line)
+				mu.Unlock()
+				conn.Write([]byte("502 Not here\r\n"))
+			}
+		}
+	}()
+	return listener.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), commands...)
+	}
+}
+
+func TestRelayNo8bitmime(t *testing.T) {
+	addr, commands := startTestHop(t)
+	b := newTestRelay(t, addr)
+	e := newTestEnvelope("Subject: caf\xc3\xa9\r\n\r\nd\xc3\xa9j\xc3\xa0 vu\r\n", "alice@example.com")
+	e.MailParams = map[string]string{"BODY": "8BITMIME"}
+	_, err := b.Process(e)
+	if err == nil || isPermanent(err) {
+		t.Fatalf("got %v, want a temporary failure", err)
+	}
+	if got := commands(); len(got) > 0 {
+		t.Errorf("the message was sent anyway: %q", got)
+	}
+}
+
+func TestRelayRefused(t *testing.T) {
+	if _, err := NewBackend(GlobalConfig{Backend_name: "relay", Relay_addr: "127.0.0.1:25"}); err == nil {
+		t.Error("started without queue_dir")
+	}
+	_, addr, next := startTestServer(t, ServerConfig{Max_recipients: 2})
+	b := newTestRelay(t, addr)
+	e := newTestEnvelope("Subject: hi\r\n\r\nhello\r\n",
+		"alice@example.com", "bob@elsewhere.example.net", "carol@example.com", "dave@example.com")
+	_, err := b.Process(e)
+	if smtpErr, ok := err.(*SMTPError); !ok || smtpErr.Code != 452 {
+		t.Fatalf("got %v, want the 452 for dave", err)
+	}
+	if strings.Join(e.RcptTo, " ") != "bob@elsewhere.example.net dave@example.com" {
+		t.Fatalf("left to deliver: %v", e.RcptTo)
+	}
+	// tried again, dave gets it and bob is left for the dead letters
+	_, err = b.Process(e)
+	if smtpErr, ok := err.(*SMTPError); !ok || smtpErr.Code != 550 {
+		t.Fatalf("got %v, want the 550 for bob", err)
+	}
+	if len(e.RcptTo) != 1 || e.RcptTo[0] != "bob@elsewhere.example.net" {
+		t.Fatalf("left: %v", e.RcptTo)
+	}
+	saved := next.saved()
+	if len(saved) != 2 || strings.Join(saved[0].RcptTo, " ") != "alice@example.com carol@example.com" ||
+		strings.Join(saved[1].RcptTo, " ") != "dave@example.com" {
+		t.Errorf("the next hop got %d messages", len(saved))
+	}
+}
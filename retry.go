@@ -0,0 +1,108 @@
+package guerrilla
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The retry policies used for the steps that don't have one in the config
+var defaultRetryPolicies = map[string]RetryPolicy{
+	"redis":   {Max_attempts: 1},
+	"sql":     {Max_attempts: 3, Backoff: 100, Max_backoff: 2000},
+	"queue":   {Max_attempts: 20, Backoff: 5000, Max_backoff: 600000},
+	"webhook": {Max_attempts: 3, Backoff: 1000, Max_backoff: 10000},
+}
+
+// RetryPolicy returns the retry policy for a step of saving the mail, eg. "sql".
+// The settings left out of the config are taken from the default policy of the step.
+func (c GlobalConfig) RetryPolicy(step string) RetryPolicy {
+	p := defaultRetryPolicies[step]
+	if configured, ok := c.Retry[step]; ok {
+		if configured.Max_attempts > 0 {
+			p.Max_attempts = configured.Max_attempts
+		}
+		if configured.Backoff > 0 {
+			p.Backoff = configured.Backoff
+		}
+		if configured.Max_backoff > 0 {
+			p.Max_backoff = configured.Max_backoff
+		}
+	}
+	if p.Max_attempts < 1 {
+		p.Max_attempts = 1
+	}
+	return p
+}
+
+// Do calls f until it succeeds or the attempts run out, waiting longer after each failure.
+// It stops early when the wait would go past the deadline of ctx, or ctx is done.
+// The error of the last attempt is returned.
+func (p RetryPolicy) Do(ctx context.Context, f func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		if err = f(); err == nil || attempt >= p.Max_attempts {
+			return err
+		}
+		delay := p.Delay(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			// no time left for another attempt
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// Delay is how long to wait after the given number of failed attempts,
+// Backoff doubled for each failure after the first, up to Max_backoff
+func (p RetryPolicy) Delay(failures int) time.Duration {
+	d := time.Duration(p.Backoff) * time.Millisecond
+	max := time.Duration(p.Max_backoff) * time.Millisecond
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	return d
+}
+
+// breaker stops the workers from calling a backend that keeps failing.
+// After failures saves failed in a row it opens for cooldown, then lets the next save through
+// to see if the backend is back. One more failure opens it again.
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	cooldown  time.Duration
+	failed    int       // saves failed in a row
+	openUntil time.Time // zero while closed
+}
+
+// allow tells if the backend may be called, otherwise how long until it may
+func (b *breaker) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if wait := b.openUntil.Sub(time.Now()); wait > 0 {
+		return false, wait
+	}
+	return true, 0
+}
+
+// record counts the result of a save.
+// A permanent error is the message's fault, the backend is fine.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil || isPermanent(err) {
+		b.failed = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.failed++
+	if b.failed >= b.failures {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
@@ -0,0 +1,26 @@
+package guerrilla
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryDeadline(t *testing.T) {
+	p := RetryPolicy{Max_attempts: 10, Backoff: 100, Max_backoff: 100}
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	attempts := 0
+	start := time.Now()
+	err := p.Do(ctx, func() error {
+		attempts++
+		return errors.New("Down")
+	})
+	if err == nil || attempts != 3 {
+		t.Errorf("got %v after %d attempts, want an error after 3", err, attempts)
+	}
+	if took := time.Since(start); took > 250*time.Millisecond {
+		t.Errorf("returned after %v, past the deadline", took)
+	}
+}
@@ -0,0 +1,43 @@
+package guerrilla
+
+import (
+	"errors"
+	"time"
+)
+
+// The time layouts of the periods for the rotate_every setting
+var rotatePeriods = map[string]string{
+	"":      "",
+	"hour":  "2006-01-02-15",
+	"day":   "2006-01-02",
+	"month": "2006-01",
+}
+
+// rotation tells the file backends when to start a new file,
+// after maxSize bytes or when the period changed
+type rotation struct {
+	maxSize int64  // 0 for no limit
+	layout  string // time layout of the period, "" to not rotate by date
+}
+
+func newRotation(config GlobalConfig) (rotation, error) {
+	layout, ok := rotatePeriods[config.Rotate_every]
+	if !ok {
+		return rotation{}, errors.New("rotate_every must be hour, day or month")
+	}
+	return rotation{maxSize: int64(config.Rotate_size), layout: layout}, nil
+}
+
+// period is the name of the period of t, "" if not rotating by date
+func (r rotation) period(t time.Time) string {
+	if r.layout == "" {
+		return ""
+	}
+	return t.Format(r.layout)
+}
+
+// full tells if adding n bytes to a file of size bytes would make it too big.
+// An empty file is never full, so that a big message still gets written.
+func (r rotation) full(size int64, n int64) bool {
+	return r.maxSize > 0 && size > 0 && size+n > r.maxSize
+}
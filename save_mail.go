@@ -1,159 +1,192 @@
-package main
+package guerrilla
 
 import (
-	"fmt"
-	"github.com/garyburd/redigo/redis"
-	"github.com/ziutek/mymysql/autorc"
-	_ "github.com/ziutek/mymysql/godrv"
 	"log"
-	"strconv"
+	"sync"
 	"time"
-	"errors"
 )
 
 type savePayload struct {
-	client *Client
-	server *SmtpdServer
+	envelope    *Envelope
+	savedNotify chan *saveStatus // buffered, so that a worker never blocks on a client that gave up
 }
 
-var SaveMailChan chan *savePayload // workers for saving mail
+type saveStatus struct {
+	queueID string
+	err     error
+}
 
-type redisClient struct {
-	count int
-	conn  redis.Conn
-	time  int
+// SaveWorkers is a pool of workers passing the mail accepted by one or more servers to a Backend
+type SaveWorkers struct {
+	backend      Backend
+	saveMailChan chan *savePayload
+	quit         chan struct{} // tells one worker to stop, see Resize
+	wg           sync.WaitGroup
+	mu           sync.Mutex
+	size         int
+	queue        *diskQueue       // nil unless OpenQueue was called
+	queuePolicy  RetryPolicy      // for saving the messages from the queue
+	queued       chan *queueEntry // messages from the queue, ready to be saved
+	stopped      chan struct{}    // closed by Stop
+	breaker      *breaker
+	saveTimeout  time.Duration // how long a client waits for its message to be saved
 }
 
-func saveMail() {
-	var to, recipient, body string
-	var err error
+// NewSaveWorkers starts size workers calling backend.Process
+func NewSaveWorkers(backend Backend, size int) *SaveWorkers {
+	w := &SaveWorkers{
+		backend:      backend,
+		saveMailChan: make(chan *savePayload, size),
+		quit:         make(chan struct{}),
+		queued:       make(chan *queueEntry),
+		stopped:      make(chan struct{}),
+		breaker:      &breaker{failures: 5, cooldown: 30 * time.Second},
+		saveTimeout:  30 * time.Second,
+	}
+	w.Resize(size)
+	return w
+}
+
+// SetBreaker sets when the backend is considered unhealthy: after the given number of
+// saves failed in a row, the backend is not called for cooldown. Meanwhile the clients
+// are told to try again later, or their mail waits in the queue if there is one.
+// The settings are read by the workers without locking, so set them before any mail comes in.
+func (w *SaveWorkers) SetBreaker(failures int, cooldown time.Duration) {
+	w.breaker.failures = failures
+	w.breaker.cooldown = cooldown
+}
 
-	var redis_err error
-	var length int
-	redisClient := &redisClient{}
-	db := autorc.New(
-		"tcp",
-		"",
-		mainConfig.Mysql_host,
-		mainConfig.Mysql_user,
-		mainConfig.Mysql_pass,
-		mainConfig.Mysql_db)
-	db.Register("set names utf8")
-	sql := "INSERT INTO " + mainConfig.Mysql_table + " "
-	sql += "(`date`, `to`, `from`, `subject`, `body`, `charset`, `mail`, `spam_score`, `hash`, `content_type`, `recipient`, `has_attach`, `ip_addr`, `return_path`, `is_tls`)"
-	sql += " values (NOW(), ?, ?, ?, ? , 'UTF-8' , ?, 0, ?, '', ?, 0, ?, ?, ?)"
-	ins, sql_err := db.Prepare(sql)
-	if sql_err != nil {
-		log.Fatalf(fmt.Sprintf("Sql statement incorrect: %s\n", sql_err))
+// SetSaveTimeout sets how long a client waits for its message to be saved before it is
+// told to try again later. The backend is given a deadline a little before, see Envelope.Deadline.
+// Each client reads the timeout without locking, so it can't be changed while the servers run.
+func (w *SaveWorkers) SetSaveTimeout(timeout time.Duration) {
+	w.saveTimeout = timeout
+}
+
+// Resize starts or stops workers until there are size workers.
+// A worker that is stopped finishes saving its current mail first.
+func (w *SaveWorkers) Resize(size int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ; w.size < size; w.size++ {
+		w.wg.Add(1)
+		go w.saveMail()
 	}
-	sql = "UPDATE gm2_setting SET `setting_value` = `setting_value`+1 WHERE `setting_name`='received_emails' LIMIT 1"
-	incr, sql_err := db.Prepare(sql)
-	if sql_err != nil {
-		log.Fatalf(fmt.Sprintf("Sql statement incorrect: %s\n", sql_err))
+	for ; w.size > size && w.size > 1; w.size-- {
+		w.quit <- struct{}{}
 	}
+}
 
-	//  receives values from the channel repeatedly until it is closed.
-	for {
-		payload := <-SaveMailChan
-		if user, host, addr_err := validateEmailData(payload.client); addr_err != nil {
-			payload.server.logln(1, fmt.Sprintf("mail_from didnt validate: %v", addr_err)+" client.mail_from:"+payload.client.mail_from)
-			// notify client that a save completed, -1 = error
-			payload.client.savedNotify <- -1
-			continue
-		} else {
-			recipient = user + "@" + host
-			to = user + "@" + mainConfig.Primary_host
-		}
-		length = len(payload.client.data)
-		ts := strconv.FormatInt(time.Now().UnixNano(), 10);
-		payload.client.subject = mimeHeaderDecode(payload.client.subject)
-		payload.client.hash = md5hex(
-			&to,
-			&payload.client.mail_from,
-			&payload.client.subject,
-			&ts)
-		// Add extra headers
-		add_head := ""
-		add_head += "Delivered-To: " + to + "\r\n"
-		add_head += "Received: from " + payload.client.helo + " (" + payload.client.helo + "  [" + payload.client.address + "])\r\n"
-		add_head += "	by " + payload.server.Config.Host_name + " with SMTP id " + payload.client.hash + "@" +
-			payload.server.Config.Host_name + ";\r\n"
-		add_head += "	" + time.Now().Format(time.RFC1123Z) + "\r\n"
-		// compress to save space
-		payload.client.data = compress(&add_head, &payload.client.data)
-		body = "gzencode"
-		redis_err = redisClient.redisConnection()
-		if redis_err == nil {
-			_, do_err := redisClient.conn.Do("SETEX", payload.client.hash, mainConfig.Redis_expire_seconds, payload.client.data)
-			if do_err == nil {
-				payload.client.data = ""
-				body = "redis"
-			}
-		} else {
-			payload.server.logln(1, fmt.Sprintf("redis: %v", redis_err))
-		}
-		// bind data to cursor
-		ins.Bind(
-			to,
-			payload.client.mail_from,
-			payload.client.subject,
-			body,
-			payload.client.data,
-			payload.client.hash,
-			recipient,
-			payload.client.address,
-			payload.client.mail_from,
-			payload.client.tls_on,
-		)
-		// save, discard result
-		_, _, err = ins.Exec()
-		if err != nil {
-			payload.server.logln(1, fmt.Sprintf("Database error, %v ", err))
-			payload.client.savedNotify <- -1
-		} else {
-			payload.server.logln(0, "Email saved "+payload.client.hash+" len:"+strconv.Itoa(length))
-			_, _, err = incr.Exec()
-			if err != nil {
-				payload.server.logln(1, fmt.Sprintf("Failed to incr count: %v", err))
-			}
-			payload.client.savedNotify <- 1
-		}
+// OpenQueue makes the workers save the mail through a durable queue in dir, see diskQueue.
+// The clients are then told "queued as" once their message is on disk, and a message
+// that could not be saved is tried again later as the policy says. When the attempts run out,
+// the message is moved to deadLetterDir, dir/dead if empty. Messages left in the queue when the program
+// stopped are saved again. Mail accepted before OpenQueue returns would not go through the queue,
+// so open it before starting the servers.
+func (w *SaveWorkers) OpenQueue(dir string, deadLetterDir string, policy RetryPolicy) error {
+	q, err := openDiskQueue(dir, deadLetterDir)
+	if err != nil {
+		return err
+	}
+	entries, err := q.load()
+	if err != nil {
+		return err
+	}
+	w.queue = q
+	w.queuePolicy = policy
+	if len(entries) > 0 {
+		log.Printf("queue: saving %d messages left in %s", len(entries), dir)
+	}
+	for _, entry := range entries {
+		w.retry(entry, 0)
 	}
+	return nil
 }
 
-func (c *redisClient) redisConnection() (err error) {
-
-	if c.count == 0 {
-		c.conn, err = redis.Dial("tcp", mainConfig.Redis_interface)
-		if err != nil {
-			// handle error
-			return err
-		}
+// enqueue writes e to the queue for a worker to save later, returns the id of the queued message
+func (w *SaveWorkers) enqueue(e *Envelope) (string, error) {
+	entry, err := w.queue.put(e)
+	if err != nil {
+		return "", err
 	}
-	return nil
+	w.retry(entry, 0)
+	return entry.ID, nil
 }
 
-// test database connection settings
-func testDbConnections() (err error) {
+// retry passes entry to a worker after delay.
+// If the workers are stopped first, the message stays in the queue for the next start.
+func (w *SaveWorkers) retry(entry *queueEntry, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		select {
+		case w.queued <- entry:
+		case <-w.stopped:
+			entry.Envelope.data.file.Close()
+		}
+	})
+}
 
-	db := autorc.New(
-		"tcp",
-		"",
-		mainConfig.Mysql_host,
-		mainConfig.Mysql_user,
-		mainConfig.Mysql_pass,
-		mainConfig.Mysql_db)
+// Stop waits for the mail passed to the workers to be saved, then stops the workers.
+// Mail in the queue that was not saved yet stays there, see OpenQueue.
+// The servers using the workers must be shut down first.
+func (w *SaveWorkers) Stop() {
+	close(w.saveMailChan)
+	w.wg.Wait()
+	close(w.stopped)
+}
 
-	if mysql_err := db.Raw.Connect(); mysql_err != nil {
-		err = errors.New("MySql cannot connect, check your settings. " + mysql_err.Error() )
-	} else {
-		db.Raw.Close();
+func (w *SaveWorkers) saveMail() {
+	defer w.wg.Done()
+	//  receives values from the channel repeatedly until it is closed.
+	for {
+		select {
+		case payload, ok := <-w.saveMailChan:
+			if !ok {
+				return
+			}
+			queueID, err := w.backend.Process(payload.envelope)
+			w.breaker.record(err)
+			// the client may have given up waiting, so the spool is cleaned up here
+			payload.envelope.data.Reset()
+			payload.savedNotify <- &saveStatus{queueID: queueID, err: err}
+		case entry := <-w.queued:
+			w.saveQueued(entry)
+		case <-w.quit:
+			return
+		}
 	}
+}
 
-	redisClient := &redisClient{}
-	if redis_err := redisClient.redisConnection(); redis_err != nil {
-		err = errors.New("Redis cannot connect, check your settings. " + redis_err.Error())
+// saveQueued saves a message from the queue, removing it from the queue when done.
+// If the backend failed, it is tried again later or moved to the dead letters
+// once the attempts ran out, or at once if the error is permanent.
+func (w *SaveWorkers) saveQueued(entry *queueEntry) {
+	if ok, wait := w.breaker.allow(); !ok {
+		// not an attempt, the backend is known to be unhealthy
+		w.retry(entry, wait)
+		return
 	}
-
-	return
+	_, err := w.backend.Process(entry.Envelope)
+	w.breaker.record(err)
+	if err == nil {
+		w.queue.remove(entry)
+		return
+	}
+	entry.Attempts++
+	if entry.Attempts >= w.queuePolicy.Max_attempts || isPermanent(err) {
+		log.Printf("queue: %s failed %d times, giving up: %v", entry.ID, entry.Attempts, err)
+		// with the recipients that are left, the backend may have saved the others
+		if err := w.queue.writeEntry(entry); err != nil {
+			log.Printf("queue: %v", err)
+		}
+		if err := w.queue.deadLetter(entry); err != nil {
+			log.Printf("queue: %v", err)
+		}
+		return
+	}
+	delay := w.queuePolicy.Delay(entry.Attempts)
+	log.Printf("queue: %s failed %d times, trying again in %v: %v", entry.ID, entry.Attempts, delay, err)
+	if err := w.queue.writeEntry(entry); err != nil {
+		log.Printf("queue: %v", err)
+	}
+	w.retry(entry, delay)
 }
@@ -1,4 +1,4 @@
-package main
+package guerrilla
 
 import (
 	"bufio"
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -17,15 +18,25 @@ import (
 
 const commandMaxLength = 1024
 
+// Where the client is in the SMTP conversation, see RFC 5321 section 4.1.4
+const (
+	smtpConnected = iota // waiting for HELO / EHLO
+	smtpGreeted          // waiting for MAIL
+	smtpMail             // got MAIL, waiting for RCPT
+	smtpRcpt             // got at least one RCPT, waiting for more RCPT or DATA
+	smtpData             // reading the DATA
+)
+
 type Client struct {
-	state       int
+	state       int // 0 greeting, 1 command, 2 data, 3 start TLS
+	smtpState   int // smtpConnected, smtpGreeted, etc
 	helo        string
 	mail_from   string
-	rcpt_to     string
+	rcpt_to     []string
+	mail_params map[string]string // ESMTP parameters of MAIL FROM
 	response    string
 	address     string
-	data        string
-	subject     string
+	data        *spool // the message so far, from DATA or BDAT
 	hash        string
 	time        int64
 	tls_on      bool
@@ -35,55 +46,54 @@ type Client struct {
 	kill_time   int64
 	errors      int
 	clientId    int64
-	savedNotify chan int
-}
-
-type SmtpdServer struct {
-	tlsConfig    *tls.Config
-	max_size     int // max email DATA size
-	timeout      time.Duration
-	allowedHosts map[string]bool
-	sem          chan int // currently active client list
-	Config       ServerConfig
-	logger       *log.Logger
+	idle        bool         // waiting for a command, guarded by the server's mu
+	config      ServerConfig // the server's config when the client connected
+	sem         chan int     // the server's sem that the client took a slot from
 }
 
-func (server *SmtpdServer) logln(level int, s string) {
+func (server *Server) logln(level int, s string) {
+	server.mu.Lock()
+	verbose, logFile, logger := server.config.Verbose, server.config.Log_file, server.logger
+	server.mu.Unlock()
 
-	if mainConfig.Verbose {
+	if verbose {
 		fmt.Println(s)
 	}
 	// fatal errors
 	if level == 2 {
-		server.logger.Fatalf(s)
+		logger.Fatalf(s)
 	}
 	// warnings
-	if level == 1 && len(server.Config.Log_file) > 0 {
-		server.logger.Println(s)
+	if level == 1 && len(logFile) > 0 {
+		logger.Println(s)
 	}
 
 }
 
-func (server *SmtpdServer) openLog() {
+// openLog returns the logger for sConfig and the log file it writes to, if it could be opened
+func openLog(sConfig ServerConfig) (*log.Logger, *os.File) {
 
-	server.logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	logger := log.New(&bytes.Buffer{}, "", log.Lshortfile)
 	// custom log file
-	if len(server.Config.Log_file) > 0 {
+	if len(sConfig.Log_file) > 0 {
 		logfile, err := os.OpenFile(
-			server.Config.Log_file,
+			sConfig.Log_file,
 			os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_SYNC, 0600)
 		if err != nil {
-			server.logln(1, fmt.Sprintf("Unable to open log file [%s]: %s ", server.Config.Log_file, err))
+			fmt.Printf("Unable to open log file [%s]: %s\n", sConfig.Log_file, err)
+		} else {
+			logger.SetOutput(logfile)
+			return logger, logfile
 		}
-		server.logger.SetOutput(logfile)
 	}
+	return logger, nil
 }
 
 // Upgrades the connection to TLS
 // Sets up buffers with the upgraded connection
-func (server *SmtpdServer) upgradeToTls(client *Client) bool {
+func (server *Server) upgradeToTls(client *Client) bool {
 	var tlsConn *tls.Conn
-	tlsConn = tls.Server(client.conn, server.tlsConfig)
+	tlsConn = tls.Server(client.conn, server.getTlsConfig())
 	err := tlsConn.Handshake()
 	if err == nil {
 		client.conn = net.Conn(tlsConn)
@@ -99,24 +109,27 @@ func (server *SmtpdServer) upgradeToTls(client *Client) bool {
 
 }
 
-func (server *SmtpdServer) handleClient(client *Client) {
+func (server *Server) handleClient(client *Client) {
 	defer server.closeClient(client)
+	// the replies held back for pipelined commands are sent before closing
+	defer server.responseFlush(client)
+	client.data = newSpool(client.config.Spool_dir, int64(client.config.Spool_threshold))
 	advertiseTls := "250-STARTTLS\r\n"
-	if server.Config.Tls_always_on {
+	if client.config.Tls_always_on {
 		if server.upgradeToTls(client) {
 			advertiseTls = ""
 		}
 	}
-	greeting := "220 " + server.Config.Host_name +
+	greeting := "220 " + client.config.Host_name +
 		" SMTP Guerrilla-SMTPd #" +
 		strconv.FormatInt(client.clientId, 10) +
-		" (" + strconv.Itoa(len(server.sem)) + ") " + time.Now().Format(time.RFC1123Z)
+		" (" + strconv.Itoa(len(client.sem)) + ") " + time.Now().Format(time.RFC1123Z)
 
-	if !server.Config.Start_tls_on {
+	if !client.config.Start_tls_on {
 		// STARTTLS turned off
 		advertiseTls = ""
 	}
-	for i := 0; i < 100; i++ {
+	for {
 		switch client.state {
 		case 0:
 			responseAdd(client, greeting)
@@ -129,6 +142,11 @@ func (server *SmtpdServer) handleClient(client *Client) {
 					// client closed the connection already
 					server.logln(0, fmt.Sprintf("%s: %v", client.address, err))
 					return
+				} else if err == errShuttingDown || server.isShuttingDown() {
+					// idle, or interrupted by Shutdown while waiting for a command
+					responseAdd(client, "421 "+client.config.Host_name+" Service not available, shutting down")
+					killClient(client)
+					break
 				} else if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 					// too slow, timeout
 					server.logln(0, fmt.Sprintf("%s: %v", client.address, err))
@@ -137,9 +155,12 @@ func (server *SmtpdServer) handleClient(client *Client) {
 					responseAdd(client, "500 Line too long.")
 					// kill it so that another one can connect
 					killClient(client)
+					break
 				}
+				// the connection can't be read from anymore
 				server.logln(1, fmt.Sprintf("Read error: %v", err))
-				break
+				killClient(client)
+				return
 			}
 			input = strings.Trim(input, " \n\r")
 			bound := len(input)
@@ -152,23 +173,46 @@ func (server *SmtpdServer) handleClient(client *Client) {
 				if len(input) > 5 {
 					client.helo = input[5:]
 				}
-				responseAdd(client, "250 "+server.Config.Host_name+" Hello ")
+				resetTransaction(client)
+				client.smtpState = smtpGreeted
+				responseAdd(client, "250 "+client.config.Host_name+" Hello ")
 			case strings.Index(cmd, "EHLO") == 0:
 				if len(input) > 5 {
 					client.helo = input[5:]
 				}
-				responseAdd(client, "250-"+server.Config.Host_name+
+				resetTransaction(client)
+				client.smtpState = smtpGreeted
+				responseAdd(client, "250-"+client.config.Host_name+
 					" Hello "+client.helo+"["+client.address+"]"+"\r\n"+
-					"250-SIZE "+strconv.Itoa(server.Config.Max_size)+"\r\n"+
+					"250-SIZE "+strconv.Itoa(client.config.Max_size)+"\r\n"+
 					"250-PIPELINING \r\n"+
+					"250-8BITMIME\r\n"+
+					"250-SMTPUTF8\r\n"+
+					"250-CHUNKING\r\n"+
+					"250-BINARYMIME\r\n"+
 					advertiseTls+"250 HELP")
 			case strings.Index(cmd, "HELP") == 0:
 				responseAdd(client, "250 Help! I need somebody...")
 			case strings.Index(cmd, "MAIL FROM:") == 0:
-				if len(input) > 10 {
-					client.mail_from = input[10:]
+				if client.smtpState != smtpGreeted {
+					responseAdd(client, "503 Bad sequence of commands")
+					break
+				}
+				path, params, err := parsePath(input[10:])
+				if err != nil {
+					responseAdd(client, "501 "+err.Error())
+				} else if reply := checkMailParams(params, client.config.Max_size); reply != "" {
+					responseAdd(client, reply)
+				} else if _, utf8 := params["SMTPUTF8"]; !utf8 && !isASCII(path) {
+					responseAdd(client, "553 Error: non-ASCII address without SMTPUTF8")
+				} else if from, err := validateMailFrom(path); err != nil {
+					responseAdd(client, "501 Error: "+err.Error())
+				} else {
+					client.mail_from = from
+					client.mail_params = params
+					client.smtpState = smtpMail
+					responseAdd(client, "250 Ok")
 				}
-				responseAdd(client, "250 Ok")
 			case strings.Index(cmd, "XCLIENT") == 0:
 				// Nginx sends this
 				// XCLIENT ADDR=212.96.64.216 NAME=[UNAVAILABLE]
@@ -177,22 +221,50 @@ func (server *SmtpdServer) handleClient(client *Client) {
 				fmt.Println("client address:[" + client.address + "]")
 				responseAdd(client, "250 OK")
 			case strings.Index(cmd, "RCPT TO:") == 0:
-				if len(input) > 8 {
-					client.rcpt_to = input[8:]
+				if client.smtpState != smtpMail && client.smtpState != smtpRcpt {
+					responseAdd(client, "503 Bad sequence of commands")
+					break
+				}
+				path, params, err := parsePath(input[8:])
+				if err != nil {
+					responseAdd(client, "501 "+err.Error())
+				} else if len(params) > 0 {
+					// no RCPT TO parameters are supported (eg. NOTIFY, ORCPT of DSN)
+					responseAdd(client, "555 RCPT TO parameters not recognized or not implemented")
+				} else if _, utf8 := client.mail_params["SMTPUTF8"]; !utf8 && !isASCII(path) {
+					responseAdd(client, "553 Error: non-ASCII address without SMTPUTF8")
+				} else if len(client.rcpt_to) >= client.config.Max_recipients {
+					responseAdd(client, "452 Too many recipients")
+				} else if rcpt, err := validateRcpt(path, server.getAllowedHosts()); err != nil {
+					responseAdd(client, "550 Error: "+err.Error())
+				} else {
+					client.rcpt_to = append(client.rcpt_to, rcpt)
+					client.smtpState = smtpRcpt
+					responseAdd(client, "250 Accepted")
 				}
-				responseAdd(client, "250 Accepted")
 			case strings.Index(cmd, "NOOP") == 0:
 				responseAdd(client, "250 OK")
 			case strings.Index(cmd, "RSET") == 0:
-				client.mail_from = ""
-				client.rcpt_to = ""
+				resetTransaction(client)
 				responseAdd(client, "250 OK")
+			case strings.Index(cmd, "BDAT") == 0:
+				server.readChunk(client, input)
 			case strings.Index(cmd, "DATA") == 0:
-				responseAdd(client, "354 Enter message, ending with \".\" on a line by itself")
-				client.state = 2
+				if strings.ToUpper(client.mail_params["BODY"]) == "BINARYMIME" {
+					responseAdd(client, "503 Error: BINARYMIME needs BDAT")
+				} else if client.smtpState == smtpMail {
+					// all the recipients were rejected
+					responseAdd(client, "554 Error: no valid recipients")
+				} else if client.smtpState != smtpRcpt {
+					responseAdd(client, "503 Bad sequence of commands")
+				} else {
+					responseAdd(client, "354 Enter message, ending with \".\" on a line by itself")
+					client.smtpState = smtpData
+					client.state = 2
+				}
 			case (strings.Index(cmd, "STARTTLS") == 0) &&
 				!client.tls_on &&
-				server.Config.Start_tls_on:
+				client.config.Start_tls_on:
 				responseAdd(client, "220 Ready to start TLS")
 				// go to start TLS state
 				client.state = 3
@@ -200,57 +272,53 @@ func (server *SmtpdServer) handleClient(client *Client) {
 				responseAdd(client, "221 Bye")
 				killClient(client)
 			default:
-				responseAdd(client, "500 unrecognized command: "+cmd)
 				client.errors++
 				if client.errors > 3 {
 					responseAdd(client, "500 Too many unrecognized commands")
 					killClient(client)
+				} else {
+					responseAdd(client, "500 unrecognized command: "+cmd)
 				}
 			}
 		case 2:
-			var err error
-			client.bufin.setLimit(int64(server.Config.Max_size) + 1024000) // This is a hard limit.
-			client.data, err = server.readSmtp(client)
-			if err == nil {
-				if _, _, mailErr := validateEmailData(client); mailErr == nil {
-					// to do: timeout when adding to SaveMailChan
-					// place on the channel so that one of the save mail workers can pick it up
-					SaveMailChan <- &savePayload{client: client, server: server}
-					// wait for the save to complete
-					// or timeout
-					select {
-					case status := <-client.savedNotify:
-						if status == 1 {
-							responseAdd(client, "250 OK : queued as "+client.hash)
-						} else {
-							responseAdd(client, "554 Error: transaction failed, blame it on the weather")
-						}
-					case <-time.After(time.Second * 30):
-						fmt.Println("timeout 1")
-						responseAdd(client, "554 Error: transaction timeout")
-					}
-
-				} else {
-					responseAdd(client, "550 Error: "+mailErr.Error())
-				}
-
+			client.bufin.setLimit(int64(client.config.Max_size) + 1024000) // This is a hard limit.
+			_, err := io.Copy(client.data, newDataReader(server, client))
+			if err == nil && client.data.Err() != nil {
+				server.logln(1, fmt.Sprintf("Spool error: %v", client.data.Err()))
+				responseAdd(client, "451 Error: local error in processing")
+			} else if err == nil {
+				server.queueMessage(client)
 			} else {
-				if (err == INPUT_LIMIT_EXCEEDED) {
+				if err == errMessageTooBig {
+					// the whole DATA was read, so we can carry on with the next command
+					responseAdd(client, "552 Error: Maximum DATA size exceeded ("+strconv.Itoa(client.config.Max_size)+")")
+				} else if err == INPUT_LIMIT_EXCEEDED {
 					// hard limit reached, end to make room for other clients
 					responseAdd(client, "550 Error: DATA limit exceeded by more than a megabyte!")
 					killClient(client)
 				} else {
+					// we don't know where the DATA ends
 					responseAdd(client, "550 Error: "+err.Error())
+					killClient(client)
 				}
 
 				server.logln(1, fmt.Sprintf("DATA read error: %v", err))
 			}
+			// ready for the next message
+			resetTransaction(client)
 			client.state = 1
 		case 3:
 			// upgrade to TLS
 			if server.upgradeToTls(client) {
 				advertiseTls = ""
+				// start over, the client has to say EHLO again
+				resetTransaction(client)
+				client.smtpState = smtpConnected
 				client.state = 1
+			} else {
+				// the connection is of no use after a failed handshake
+				killClient(client)
+				return
 			}
 		}
 		// Send a response back to the client
@@ -272,13 +340,205 @@ func (server *SmtpdServer) handleClient(client *Client) {
 
 }
 
-// add a response on the response buffer
+// queueMessage passes the message to the save workers, waits for it to be saved and replies
+func (server *Server) queueMessage(client *Client) {
+	savedNotify := make(chan *saveStatus, 1)
+	header, err := ReadHeader(client.data.NewReader())
+	if err != nil {
+		server.logln(1, fmt.Sprintf("Header error: %v", err))
+	}
+	envelope := &Envelope{
+		RemoteAddress: client.address,
+		Helo:          client.helo,
+		MailFrom:      client.mail_from,
+		MailParams:    client.mail_params,
+		RcptTo:        client.rcpt_to,
+		Header:        header,
+		Subject:       header.Get("Subject"),
+		TLS:           client.tls_on,
+		ServerName:    client.config.Host_name,
+		QueueID:       newID("", client.mail_from, header.Get("Subject")),
+		data:          client.data,
+	}
+	// the envelope has the data now, the worker cleans it up after saving
+	client.data = newSpool(client.config.Spool_dir, int64(client.config.Spool_threshold))
+	size := envelope.Size()
+	if server.saveWorkers.queue != nil {
+		// reply as soon as the message is safely on disk
+		id, err := server.saveWorkers.enqueue(envelope)
+		envelope.data.Reset()
+		if err != nil {
+			server.logln(1, fmt.Sprintf("Queue error: %v", err))
+			responseAdd(client, "451 Error: local error in processing")
+			return
+		}
+		client.hash = id
+		server.logln(0, "Email queued "+client.hash+" len:"+strconv.FormatInt(size, 10))
+		responseAdd(client, "250 OK : queued as "+client.hash)
+		return
+	}
+	if ok, _ := server.saveWorkers.breaker.allow(); !ok {
+		// don't make the client wait for a backend that is failing
+		envelope.data.Reset()
+		responseAdd(client, "451 4.3.0 Error: temporary failure, try again later")
+		return
+	}
+	// the backend has to give up a little before the client stops waiting, so that the
+	// client is told what happened instead of trying again while the message may be saved
+	timeout := server.saveWorkers.saveTimeout
+	envelope.Deadline = time.Now().Add(timeout - timeout/10)
+	waitUntil := time.After(timeout)
+	// place on the channel so that one of the save mail workers can pick it up
+	select {
+	case server.saveWorkers.saveMailChan <- &savePayload{envelope: envelope, savedNotify: savedNotify}:
+	case <-waitUntil:
+		// all the workers are busy
+		envelope.data.Reset()
+		responseAdd(client, "451 4.3.0 Error: transaction timeout, try again later")
+		return
+	}
+	// wait for the save to complete
+	// or timeout
+	select {
+	case status := <-savedNotify:
+		if status.err == nil {
+			client.hash = status.queueID
+			server.logln(0, "Email saved "+client.hash+" len:"+strconv.FormatInt(size, 10))
+			responseAdd(client, "250 OK : queued as "+client.hash)
+		} else {
+			server.logln(1, fmt.Sprintf("Save error, id:%s: %v", envelope.QueueID, status.err))
+			if smtpErr, ok := status.err.(*SMTPError); ok {
+				responseAdd(client, smtpErr.Error())
+			} else {
+				responseAdd(client, "451 4.3.0 Error: temporary failure, try again later")
+			}
+		}
+	case <-waitUntil:
+		fmt.Println("timeout 1")
+		responseAdd(client, "451 4.3.0 Error: transaction timeout, try again later")
+	}
+}
+
+// readChunk reads the chunk that follows "BDAT <size> [LAST]", see RFC 3030.
+// The chunk is read exactly, without looking for a terminating dot, so it may be binary.
+// The message is queued after the LAST chunk.
+func (server *Server) readChunk(client *Client, input string) {
+	args := strings.Fields(input[4:])
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && strings.ToUpper(args[1]) != "LAST") {
+		responseAdd(client, "501 Syntax: BDAT chunk-size [LAST]")
+		return
+	}
+	size, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || size < 0 {
+		// we don't know how much to read, so we are out of step with the client
+		responseAdd(client, "501 Syntax: BDAT chunk-size [LAST]")
+		killClient(client)
+		return
+	}
+	last := len(args) == 2
+	total := client.data.Len() + size
+	hardLimit := int64(client.config.Max_size) + 1024000
+	if total > hardLimit {
+		// not worth reading it
+		responseAdd(client, "552 Error: DATA limit exceeded by more than a megabyte!")
+		killClient(client)
+		return
+	}
+	// the chunk has to be read even if we are not going to accept it
+	var dst io.Writer = ioutil.Discard
+	inSequence := client.smtpState == smtpRcpt || client.smtpState == smtpData
+	if inSequence && total <= int64(client.config.Max_size) {
+		dst = client.data
+	}
+	client.bufin.setLimit(size)
+	for size > 0 && err == nil {
+		client.conn.SetDeadline(time.Now().Add(time.Duration(client.config.Timeout) * time.Second))
+		n := size
+		if n > 65536 {
+			n = 65536
+		}
+		n, err = io.CopyN(dst, client.bufin, n)
+		size -= n
+	}
+	if err != nil {
+		server.logln(1, fmt.Sprintf("BDAT read error: %v", err))
+		killClient(client)
+		return
+	}
+	switch {
+	case client.smtpState == smtpMail:
+		// all the recipients were rejected, as DATA answers
+		responseAdd(client, "554 Error: no valid recipients")
+	case !inSequence:
+		responseAdd(client, "503 Bad sequence of commands")
+	case total > int64(client.config.Max_size):
+		responseAdd(client, "552 Error: Maximum DATA size exceeded ("+strconv.Itoa(client.config.Max_size)+")")
+		resetTransaction(client)
+	case client.data.Err() != nil:
+		server.logln(1, fmt.Sprintf("Spool error: %v", client.data.Err()))
+		responseAdd(client, "451 Error: local error in processing")
+		resetTransaction(client)
+	case !last:
+		client.smtpState = smtpData
+		responseAdd(client, "250 "+args[0]+" octets received")
+	default:
+		server.queueMessage(client)
+		resetTransaction(client)
+	}
+}
+
+// checkMailParams checks the ESMTP parameters of MAIL FROM,
+// returns the reply for the client if they cannot be accepted
+func checkMailParams(params map[string]string, maxSize int) string {
+	for keyword, value := range params {
+		switch keyword {
+		case "SIZE":
+			// RFC 1870, the client tells us how big the message will be
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 0 {
+				return "501 Syntax error in SIZE parameter"
+			}
+			if size > maxSize {
+				return "552 Message size exceeds fixed maximum message size (" + strconv.Itoa(maxSize) + ")"
+			}
+		case "BODY":
+			// RFC 6152
+			if body := strings.ToUpper(value); body != "7BIT" && body != "8BITMIME" && body != "BINARYMIME" {
+				return "501 Unsupported BODY type " + value
+			}
+		case "SMTPUTF8":
+			// RFC 6531
+			if value != "" {
+				return "501 SMTPUTF8 does not take a value"
+			}
+		default:
+			return "555 MAIL FROM parameters not recognized or not implemented"
+		}
+	}
+	return ""
+}
+
+// resetTransaction forgets the current message, as after RSET or a completed DATA
+func resetTransaction(client *Client) {
+	client.mail_from = ""
+	client.mail_params = nil
+	client.rcpt_to = nil
+	client.data.Reset()
+	client.hash = ""
+	if client.smtpState > smtpGreeted {
+		client.smtpState = smtpGreeted
+	}
+}
+
+// add a response on the response buffer, after the responses to any earlier pipelined commands
 func responseAdd(client *Client, line string) {
-	client.response = line + "\r\n"
+	client.response = client.response + line + "\r\n"
 }
-func (server *SmtpdServer) closeClient(client *Client) {
+func (server *Server) closeClient(client *Client) {
 	client.conn.Close()
-	<-server.sem // Done; enable next client to run.
+	client.data.Reset()
+	server.removeClient(client)
+	<-client.sem // Done; enable next client to run.
 }
 func killClient(client *Client) {
 	client.kill_time = time.Now().Unix()
@@ -321,13 +581,11 @@ type smtpBufferedReader struct {
 	alr *adjustableLimitedReader
 }
 
-
 // delegate to the adjustable limited reader
 func (sbr *smtpBufferedReader) setLimit(n int64) {
 	sbr.alr.setLimit(n)
 }
 
-
 // allocate a new smtpBufferedReader
 func newSmtpBufferedReader(rd io.Reader) *smtpBufferedReader {
 	alr := newAdjustableLimitedReader(rd, commandMaxLength)
@@ -335,62 +593,121 @@ func newSmtpBufferedReader(rd io.Reader) *smtpBufferedReader {
 	return s
 }
 
-// Reads from the smtpBufferedReader, can be in command state or data state.
-func (server *SmtpdServer) readSmtp(client *Client) (input string, err error) {
-	var reply string
-	// Command state terminator by default
-	suffix := "\r\n"
-	if client.state == 2 {
-		// DATA state ends with a dot on a line by itself
-		suffix = "\r\n.\r\n"
-	}
-	for err == nil {
-		client.conn.SetDeadline(time.Now().Add(server.timeout * time.Second))
-		reply, err = client.bufin.ReadString('\n')
-		if reply != "" {
-			input = input + reply
-			if len(input) > server.Config.Max_size {
-				err = errors.New("Maximum DATA size exceeded (" + strconv.Itoa(server.Config.Max_size) + ")")
-				return input, err
-			}
-			if client.state == 2 {
-				// Extract the subject while we are at it.
-				scanSubject(client, reply)
+// Reads a command line from the smtpBufferedReader, the DATA is read with a dataReader
+func (server *Server) readSmtp(client *Client) (input string, err error) {
+	defer server.setBusy(client)
+	if err = server.setDeadline(client); err != nil {
+		return "", err
+	}
+	return client.bufin.ReadString('\n')
+}
+
+var errMessageTooBig = errors.New("Maximum DATA size exceeded")
+
+// dataReader reads the DATA from the client, like textproto.DotReader does.
+// The leading dot of a line is removed (dot-unstuffing, RFC 5321 section 4.5.2) and
+// io.EOF is returned at the <CRLF>.<CRLF> that ends the DATA, which is not part of the message.
+// Only CRLF ends a line, a bare LF does not. The hard limit is the limit of client.bufin.
+// If the DATA is bigger than Max_size, the rest of it is discarded and errMessageTooBig
+// is returned once the end was reached, so that the client can carry on.
+type dataReader struct {
+	server    *Server
+	client    *Client
+	line      []byte // what is left of the current line
+	lineStart bool   // the next read from bufin is at the start of a line
+	lastCR    bool   // the last read from bufin ended with CR
+	size      int64  // bytes of the message read so far
+	done      bool   // the terminating dot was read
+}
+
+func newDataReader(server *Server, client *Client) *dataReader {
+	return &dataReader{server: server, client: client, lineStart: true}
+}
+
+func (d *dataReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if len(d.line) > 0 {
+			c := copy(p[n:], d.line)
+			d.line = d.line[c:]
+			n += c
+			continue
+		}
+		if d.done {
+			if d.size > int64(d.client.config.Max_size) {
+				return n, errMessageTooBig
 			}
+			return n, io.EOF
 		}
-		if err != nil {
-			break
+		if n > 0 && d.client.bufin.Buffered() == 0 {
+			// don't wait for the client when there is something to return
+			return n, nil
 		}
-		if strings.HasSuffix(input, suffix) {
-			break
+		if err = d.readLine(); err != nil {
+			return n, err
 		}
 	}
-	return input, err
+	return n, nil
 }
 
-// Scan the data part for a Subject line. Can be a multi-line
-func scanSubject(client *Client, reply string) {
-	if client.subject == "" && (len(reply) > 8) {
-		test := strings.ToUpper(reply[0:9])
-		if i := strings.Index(test, "SUBJECT: "); i == 0 {
-			// first line with \r\n
-			client.subject = reply[9:]
+// readLine reads the next line, or the next part of a long line, into d.line
+func (d *dataReader) readLine() error {
+	d.server.setDeadline(d.client)
+	line, err := d.client.bufin.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// a long line, the rest comes with the next read
+		err = nil
+	} else if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	start := d.lineStart
+	end := len(line) - 1
+	d.lineStart = line[end] == '\n' && ((end > 0 && line[end-1] == '\r') || (end == 0 && d.lastCR))
+	d.lastCR = line[end] == '\r'
+	if start {
+		if string(line) == ".\r\n" {
+			d.done = true
+			return nil
 		}
-	} else if strings.HasSuffix(client.subject, "\r\n") {
-		// chop off the \r\n
-		client.subject = client.subject[0 : len(client.subject)-2]
-		if (strings.HasPrefix(reply, " ")) || (strings.HasPrefix(reply, "\t")) {
-			// subject is multi-line
-			client.subject = client.subject + reply[1:]
+		if line[0] == '.' {
+			line = line[1:]
 		}
 	}
+	d.size += int64(len(line))
+	if d.size > int64(d.client.config.Max_size) {
+		// keep reading until the end
+		line = nil
+	}
+	d.line = line
+	return nil
+}
+
+// The most held back for pipelined commands, in bytes of replies
+const responseMaxHeld = 4096
+
+// Sends the responses back to the client.
+// If the client pipelined more commands, the responses are held back to be sent
+// together with the responses to those, see RFC 2920
+func (server *Server) responseWrite(client *Client) (err error) {
+	if client.state == 1 && client.kill_time == 0 && client.bufin.Buffered() > 0 &&
+		len(client.response) < responseMaxHeld {
+		return nil
+	}
+	return server.responseFlush(client)
 }
 
-func (server *SmtpdServer) responseWrite(client *Client) (err error) {
-	var size int
-	client.conn.SetDeadline(time.Now().Add(server.timeout * time.Second))
-	size, err = client.bufout.WriteString(client.response)
-	client.bufout.Flush()
-	client.response = client.response[size:]
+// Sends the responses held back, if any. If that fails they are dropped, the client is gone
+func (server *Server) responseFlush(client *Client) error {
+	if client.response == "" {
+		return nil
+	}
+	client.conn.SetDeadline(time.Now().Add(time.Duration(client.config.Timeout) * time.Second))
+	_, err := client.bufout.WriteString(client.response)
+	if err == nil {
+		err = client.bufout.Flush()
+	}
+	client.response = ""
 	return err
 }
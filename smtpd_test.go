@@ -0,0 +1,322 @@
+package guerrilla
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryBackend keeps the envelopes it was given, and their messages
+type memoryBackend struct {
+	mu        sync.Mutex
+	envelopes []*Envelope
+	messages  []string
+}
+
+func (m *memoryBackend) Initialize(config GlobalConfig) error {
+	return nil
+}
+
+func (m *memoryBackend) Process(e *Envelope) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.envelopes = append(m.envelopes, e)
+	// the DATA is gone once Process returned
+	message, err := ioutil.ReadAll(e.NewReader())
+	m.messages = append(m.messages, string(message))
+	return "saved", err
+}
+
+func (m *memoryBackend) Shutdown() error {
+	return nil
+}
+
+func (m *memoryBackend) saved() []*Envelope {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Envelope(nil), m.envelopes...)
+}
+
+func (m *memoryBackend) savedMessages() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.messages...)
+}
+
+// startTestServer serves sConfig on a free port with a memoryBackend,
+// the server and the workers are stopped when the test ends
+func startTestServer(t *testing.T, sConfig ServerConfig) (*Server, string, *memoryBackend) {
+	backend := &memoryBackend{}
+	workers := NewSaveWorkers(backend, 1)
+	if sConfig.Host_name == "" {
+		sConfig.Host_name = "mx.example.com"
+	}
+	if sConfig.Allowed_hosts == "" {
+		sConfig.Allowed_hosts = "example.com"
+	}
+	if sConfig.Max_size == 0 {
+		sConfig.Max_size = 100000
+	}
+	if sConfig.Timeout == 0 {
+		sConfig.Timeout = 5
+	}
+	if sConfig.Max_clients == 0 {
+		sConfig.Max_clients = 10
+	}
+	server, err := NewServer(sConfig, workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+		workers.Stop()
+	})
+	return server, listener.Addr().String(), backend
+}
+
+// testClient talks to a test server one command at a time
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTestServer(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	if reply := c.reply(); !strings.HasPrefix(reply, "220 ") {
+		t.Fatalf("greeting: %q", reply)
+	}
+	return c
+}
+
+// send writes the lines as they are, without waiting for the replies
+func (c *testClient) send(lines ...string) {
+	if _, err := c.conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// reply reads a reply, all the lines of it if it has several
+func (c *testClient) reply() string {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var reply string
+	for {
+		line, err := c.r.ReadString('\n')
+		reply += line
+		if err != nil || len(line) < 4 || line[3] == ' ' {
+			return reply
+		}
+	}
+}
+
+// cmd sends line and returns the reply to it
+func (c *testClient) cmd(line string) string {
+	c.send(line)
+	return c.reply()
+}
+
+func TestMaxRecipients(t *testing.T) {
+	_, addr, backend := startTestServer(t, ServerConfig{})
+	c := dialTestServer(t, addr)
+	c.cmd("EHLO client.example.com")
+	if reply := c.cmd("MAIL FROM:<sender@example.org>"); !strings.HasPrefix(reply, "250") {
+		t.Fatalf("MAIL: %q", reply)
+	}
+	// the default limit
+	const max = 100
+	for i := 0; i < max; i++ {
+		if reply := c.cmd("RCPT TO:<user" + strconv.Itoa(i) + "@example.com>"); !strings.HasPrefix(reply, "250") {
+			t.Fatalf("RCPT %d: %q", i, reply)
+		}
+	}
+	if reply := c.cmd("RCPT TO:<one.too.many@example.com>"); !strings.HasPrefix(reply, "452") {
+		t.Fatalf("RCPT %d: %q", max, reply)
+	}
+	if reply := c.cmd("DATA"); !strings.HasPrefix(reply, "354") {
+		t.Fatalf("DATA: %q", reply)
+	}
+	if reply := c.cmd("Subject: hi\r\n\r\nhello\r\n."); !strings.HasPrefix(reply, "250") {
+		t.Fatalf("end of DATA: %q", reply)
+	}
+	saved := backend.saved()
+	if len(saved) != 1 || len(saved[0].RcptTo) != max {
+		t.Fatalf("saved %d messages", len(saved))
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	_, addr, backend := startTestServer(t, ServerConfig{})
+	c := dialTestServer(t, addr)
+	lines := []string{"EHLO client.example.com"}
+	for i := 0; i < 60; i++ {
+		lines = append(lines, "NOOP")
+	}
+	lines = append(lines, "MAIL FROM:<sender@example.org>")
+	for i := 0; i < 50; i++ {
+		lines = append(lines, "RCPT TO:<user"+strconv.Itoa(i)+"@example.com>")
+	}
+	lines = append(lines, "DATA")
+	c.send(lines...)
+	for i, line := range lines {
+		reply := c.reply()
+		if i == len(lines)-1 {
+			if !strings.HasPrefix(reply, "354") {
+				t.Fatalf("%s: %q", line, reply)
+			}
+		} else if !strings.HasPrefix(reply, "250") {
+			t.Fatalf("%s: %q", line, reply)
+		}
+	}
+	c.send("Subject: hi", "", "hello", ".", "QUIT")
+	if reply := c.reply(); !strings.HasPrefix(reply, "250") {
+		t.Fatalf("end of DATA: %q", reply)
+	}
+	if reply := c.reply(); !strings.HasPrefix(reply, "221") {
+		t.Fatalf("QUIT: %q", reply)
+	}
+	if saved := backend.saved(); len(saved) != 1 || len(saved[0].RcptTo) != 50 {
+		t.Fatalf("saved %d messages", len(saved))
+	}
+}
+
+func TestShutdownBetweenChunks(t *testing.T) {
+	server, addr, backend := startTestServer(t, ServerConfig{})
+	c := dialTestServer(t, addr)
+	c.cmd("EHLO client.example.com")
+	c.cmd("MAIL FROM:<sender@example.org> BODY=BINARYMIME")
+	c.cmd("RCPT TO:<user@example.com>")
+	c.send("BDAT 5")
+	c.conn.Write([]byte("Subje"))
+	if reply := c.reply(); !strings.HasPrefix(reply, "250") {
+		t.Fatalf("BDAT 5: %q", reply)
+	}
+	go server.Shutdown(context.Background())
+	for !server.isShuttingDown() {
+		time.Sleep(time.Millisecond)
+	}
+	c.send("BDAT 17 LAST")
+	c.conn.Write([]byte("ct: hi\r\n\r\nhello\r\n"))
+	if reply := c.reply(); !strings.HasPrefix(reply, "250") {
+		t.Fatalf("BDAT LAST: %q", reply)
+	}
+	// the next command is not waited for
+	if reply := c.reply(); !strings.HasPrefix(reply, "421") {
+		t.Fatalf("after the message: %q", reply)
+	}
+	if saved := backend.saved(); len(saved) != 1 {
+		t.Fatalf("saved %d messages", len(saved))
+	}
+}
+
+func TestNoValidRecipients(t *testing.T) {
+	_, addr, backend := startTestServer(t, ServerConfig{})
+	c := dialTestServer(t, addr)
+	c.cmd("EHLO client.example.com")
+	c.cmd("MAIL FROM:<sender@example.org>")
+	if reply := c.cmd("RCPT TO:<user@elsewhere.example.net>"); !strings.HasPrefix(reply, "550") {
+		t.Fatalf("RCPT: %q", reply)
+	}
+	if reply := c.cmd("DATA"); !strings.HasPrefix(reply, "554 ") {
+		t.Fatalf("DATA: %q", reply)
+	}
+	c.send("BDAT 5 LAST")
+	c.conn.Write([]byte("hello"))
+	if reply := c.reply(); !strings.HasPrefix(reply, "554 ") {
+		t.Fatalf("BDAT: %q", reply)
+	}
+	if saved := backend.saved(); len(saved) != 0 {
+		t.Fatalf("saved %d messages", len(saved))
+	}
+}
+
+// writeTestCert writes a self-signed certificate for mx.example.com and its key to
+// a temporary directory, it returns the names of the two files
+func writeTestCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.com"},
+		DNSNames:     []string{"mx.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestStartTLSDisconnect(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	server, addr, _ := startTestServer(t, ServerConfig{
+		Start_tls_on:     true,
+		Public_key_file:  certFile,
+		Private_key_file: keyFile,
+	})
+	c := dialTestServer(t, addr)
+	if reply := c.cmd("EHLO client.example.com"); !strings.Contains(reply, "STARTTLS") {
+		t.Fatalf("EHLO: %q", reply)
+	}
+	if reply := c.cmd("STARTTLS"); !strings.HasPrefix(reply, "220") {
+		t.Fatalf("STARTTLS: %q", reply)
+	}
+	// gone before the handshake
+	c.conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- server.Shutdown(ctx) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown is still waiting for the client")
+	}
+}
@@ -0,0 +1,80 @@
+package guerrilla
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spool holds the DATA of a message while it is read from the client.
+// It is kept in memory up to threshold bytes, a bigger message is moved to a
+// temporary file in dir so that many large messages don't have to fit in memory.
+type spool struct {
+	dir       string
+	threshold int64
+	buf       bytes.Buffer
+	file      *os.File // nil while the message is in buf
+	size      int64
+	err       error // the first error writing to the file
+}
+
+func newSpool(dir string, threshold int64) *spool {
+	return &spool{dir: dir, threshold: threshold}
+}
+
+// Write appends p to the message.
+// A failure to write the file does not stop the writing, so that the DATA can be read to the end,
+// the error is kept for Err.
+func (s *spool) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return len(p), nil
+	}
+	if s.file == nil && s.size+int64(len(p)) > s.threshold {
+		if s.file, s.err = ioutil.TempFile(s.dir, "guerrilla-spool-"); s.err != nil {
+			return len(p), nil
+		}
+		if _, s.err = s.file.Write(s.buf.Bytes()); s.err != nil {
+			return len(p), nil
+		}
+		s.buf.Reset()
+	}
+	var n int
+	if s.file != nil {
+		n, s.err = s.file.Write(p)
+	} else {
+		n, _ = s.buf.Write(p)
+	}
+	s.size += int64(n)
+	return len(p), nil
+}
+
+// Err returns the error that happened while writing the file, if any
+func (s *spool) Err() error {
+	return s.err
+}
+
+// Len is the size of the message in bytes
+func (s *spool) Len() int64 {
+	return s.size
+}
+
+// NewReader returns a reader for the whole message, starting from the beginning
+func (s *spool) NewReader() io.Reader {
+	if s.file != nil {
+		return io.NewSectionReader(s.file, 0, s.size)
+	}
+	return bytes.NewReader(s.buf.Bytes())
+}
+
+// Reset empties the spool, removing its file
+func (s *spool) Reset() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+	}
+	s.buf.Reset()
+	s.size = 0
+	s.err = nil
+}
@@ -1,34 +1,86 @@
-package main
+package guerrilla
 
 import (
 	"bytes"
 	"compress/zlib"
 	"crypto/md5"
-	"encoding/base64"
 	"errors"
-	"github.com/sloonz/go-qprintable"
-	"gopkg.in/iconv.v1"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"regexp"
 	"strings"
-	"io"
-	"fmt"
 )
 
-func validateEmailData(client *Client) (user string, host string, addr_err error) {
-	if user, host, addr_err = extractEmail(client.mail_from); addr_err != nil {
-		return user, host, addr_err
+// validateMailFrom returns the sender as user@host, or "" for the null sender <> used by bounces
+func validateMailFrom(from string) (string, error) {
+	if strings.TrimSpace(from) == "<>" {
+		return "", nil
+	}
+	user, host, addr_err := extractEmail(from)
+	if addr_err != nil {
+		return "", addr_err
 	}
-	client.mail_from = user + "@" + host
-	if user, host, addr_err = extractEmail(client.rcpt_to); addr_err != nil {
-		return user, host, addr_err
+	return user + "@" + host, nil
+}
+
+// validateRcpt returns the recipient as user@host if it's on the allowed hosts
+func validateRcpt(rcpt string, allowedHosts map[string]bool) (string, error) {
+	user, host, addr_err := extractEmail(rcpt)
+	if addr_err != nil {
+		return "", addr_err
 	}
-	client.rcpt_to = user + "@" + host
 	// check if on allowed hosts
 	if allowed := allowedHosts[strings.ToLower(host)]; !allowed {
-		return user, host, errors.New("invalid host:" + host)
+		return "", errors.New("invalid host:" + host)
 	}
-	return user, host, addr_err
+	return user + "@" + host, nil
+}
+
+// parsePath splits the argument of MAIL FROM: or RCPT TO: into the path and its ESMTP parameters,
+// eg. "<user@example.com> SIZE=12345 BODY=8BITMIME".
+// The parameter keywords are upper cased, a parameter without a value maps to "".
+func parsePath(arg string) (path string, params map[string]string, err error) {
+	arg = strings.TrimSpace(arg)
+	if strings.HasPrefix(arg, "<") {
+		end := strings.Index(arg, ">")
+		if end == -1 {
+			return "", nil, errors.New("Syntax error, missing > in " + arg)
+		}
+		path, arg = arg[:end+1], arg[end+1:]
+	} else {
+		// some clients leave out the <>
+		if end := strings.IndexAny(arg, " \t"); end != -1 {
+			path, arg = arg[:end], arg[end:]
+		} else {
+			path, arg = arg, ""
+		}
+	}
+	params = make(map[string]string)
+	for _, param := range strings.Fields(arg) {
+		keyValue := strings.SplitN(param, "=", 2)
+		keyword := strings.ToUpper(keyValue[0])
+		if !esmtpKeywordRegex.MatchString(keyword) {
+			return path, params, errors.New("Syntax error in parameter " + param)
+		}
+		if len(keyValue) == 2 {
+			params[keyword] = keyValue[1]
+		} else {
+			params[keyword] = ""
+		}
+	}
+	return path, params, nil
+}
+
+var esmtpKeywordRegex, _ = regexp.Compile(`^[A-Z0-9][A-Z0-9\-]*$`)
+
+// true if str only has 7 bit characters
+func isASCII(str string) bool {
+	for i := 0; i < len(str); i++ {
+		if str[i] > 127 {
+			return false
+		}
+	}
+	return true
 }
 
 var extractEmailRegex, _ = regexp.Compile(`<(.+?)@(.+?)>`) // go home regex, you're drunk!
@@ -48,40 +100,9 @@ func extractEmail(str string) (name string, host string, err error) {
 	}
 	return name, host, err
 }
-var mimeRegex, _ = regexp.Compile(`=\?(.+?)\?([QBqp])\?(.+?)\?=`)
-// Decode strings in Mime header format
-// eg. =?ISO-2022-JP?B?GyRCIVo9dztSOWJAOCVBJWMbKEI=?=
-func mimeHeaderDecode(str string) string {
-
-	matched := mimeRegex.FindAllStringSubmatch(str, -1)
-	var charset, encoding, payload string
-	if matched != nil {
-		for i := 0; i < len(matched); i++ {
-			if len(matched[i]) > 2 {
-				charset = matched[i][1]
-				encoding = strings.ToUpper(matched[i][2])
-				payload = matched[i][3]
-				switch encoding {
-				case "B":
-					str = strings.Replace(
-						str,
-						matched[i][0],
-						mailTransportDecode(payload, "base64", charset),
-						1)
-				case "Q":
-					str = strings.Replace(
-						str,
-						matched[i][0],
-						mailTransportDecode(payload, "quoted-printable", charset),
-						1)
-				}
-			}
-		}
-	}
-	return str
-}
 
 var valihostRegex, _ = regexp.Compile(`^(([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9\-]*[a-zA-Z0-9])\.)*([A-Za-z0-9]|[A-Za-z0-9][A-Za-z0-9\-]*[A-Za-z0-9])$`)
+
 func validHost(host string) string {
 	host = strings.Trim(host, " ")
 	if valihostRegex.MatchString(host) {
@@ -90,80 +111,11 @@ func validHost(host string) string {
 	return ""
 }
 
-// decode from 7bit to 8bit UTF-8
-// encoding_type can be "base64" or "quoted-printable"
-func mailTransportDecode(str string, encoding_type string, charset string) string {
-	if charset == "" {
-		charset = "UTF-8"
-	} else {
-		charset = strings.ToUpper(charset)
-	}
-	if encoding_type == "base64" {
-		str = fromBase64(str)
-	} else if encoding_type == "quoted-printable" {
-		str = fromQuotedP(str)
-	}
-
-	if charset != "UTF-8" {
-		charset = fixCharset(charset)
-		if cd, err := iconv.Open("UTF-8", charset); err == nil {
-			defer func() {
-				cd.Close()
-				if r := recover(); r != nil {
-					//logln(1, fmt.Sprintf("Recovered in %v", r))
-				}
-			}()
-			// eg. charset can be "ISO-2022-JP"
-			return cd.ConvString(str)
-		}
-
-	}
-	return str
-}
-
-func fromBase64(data string) string {
-	buf := bytes.NewBufferString(data)
-	decoder := base64.NewDecoder(base64.StdEncoding, buf)
-	res, _ := ioutil.ReadAll(decoder)
-	return string(res)
-}
-
-func fromQuotedP(data string) string {
-	buf := bytes.NewBufferString(data)
-	decoder := qprintable.NewDecoder(qprintable.BinaryEncoding, buf)
-	res, _ := ioutil.ReadAll(decoder)
-	return string(res)
-}
-
-
-var charsetRegex, _ = regexp.Compile(`[_:.\/\\]`)
-func fixCharset(charset string) string {
-	fixed_charset := charsetRegex.ReplaceAllString(charset, "-")
-	// Fix charset
-	// borrowed from http://squirrelmail.svn.sourceforge.net/viewvc/squirrelmail/trunk/squirrelmail/include/languages.php?revision=13765&view=markup
-	// OE ks_c_5601_1987 > cp949
-	fixed_charset = strings.Replace(fixed_charset, "ks-c-5601-1987", "cp949", -1)
-	// Moz x-euc-tw > euc-tw
-	fixed_charset = strings.Replace(fixed_charset, "x-euc", "euc", -1)
-	// Moz x-windows-949 > cp949
-	fixed_charset = strings.Replace(fixed_charset, "x-windows_", "cp", -1)
-	// windows-125x and cp125x charsets
-	fixed_charset = strings.Replace(fixed_charset, "windows-", "cp", -1)
-	// ibm > cp
-	fixed_charset = strings.Replace(fixed_charset, "ibm", "cp", -1)
-	// iso-8859-8-i -> iso-8859-8
-	fixed_charset = strings.Replace(fixed_charset, "iso-8859-8-i", "iso-8859-8", -1)
-	if charset != fixed_charset {
-		return fixed_charset
-	}
-	return charset
-}
-
 // returns an md5 hash as string of hex characters
 func md5hex(stringArguments ...*string) string {
 	h := md5.New()
 	var r *strings.Reader
-	for i:=0; i < len(stringArguments); i++ {
+	for i := 0; i < len(stringArguments); i++ {
 		r = strings.NewReader(*stringArguments[i])
 		io.Copy(h, r)
 	}
@@ -171,15 +123,15 @@ func md5hex(stringArguments ...*string) string {
 	return fmt.Sprintf("%x", sum)
 }
 
-// concatenate & compress all strings  passed in
-func compress(stringArguments ...*string) string {
+// concatenate & compress all readers passed in
+func compress(readers ...io.Reader) (string, error) {
 	var b bytes.Buffer
-	var r *strings.Reader
 	w, _ := zlib.NewWriterLevel(&b, zlib.BestSpeed)
-	for i:=0; i < len(stringArguments); i++ {
-		r = strings.NewReader(*stringArguments[i])
-		io.Copy(w, r)
+	for i := 0; i < len(readers); i++ {
+		if _, err := io.Copy(w, readers[i]); err != nil {
+			return "", err
+		}
 	}
 	w.Close()
-	return b.String()
+	return b.String(), nil
 }
@@ -0,0 +1,208 @@
+package guerrilla
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// The webhook backend POSTs each message to webhook_url as multipart/form-data,
+// with two parts: "envelope", the JSON of a webhookEnvelope, and "message", the message
+// as received. If webhook_secret is set, the request is signed: the
+// X-Guerrilla-Signature header is "sha256=" and the hex HMAC-SHA256, keyed with the
+// secret, of the X-Guerrilla-Timestamp header, a '.' and the request body.
+// A 2xx response saves the message. A 4xx response rejects it, the client gets a 554.
+// Otherwise the request is tried again as the "webhook" retry policy says, then the
+// client gets a 451 to try again later. The attempts stop at the envelope's deadline,
+// so that the client gets a reply before it stops waiting.
+func init() {
+	RegisterBackend("webhook", func() Backend {
+		return &webhookBackend{}
+	})
+}
+
+// webhookEnvelope is the "envelope" part of the request
+type webhookEnvelope struct {
+	Helo          string         `json:"helo"`
+	RemoteAddress string         `json:"remote_address"`
+	TLS           bool           `json:"tls"`
+	MailFrom      string         `json:"mail_from"`
+	Recipients    []string       `json:"recipients"`
+	Hash          string         `json:"hash"`
+	Subject       string         `json:"subject"` // decoded
+	ServerName    string         `json:"server_name"`
+	Parsed        *ParsedMessage `json:"parsed,omitempty"` // with the mime processor before the webhook
+}
+
+type webhookBackend struct {
+	url     string
+	secret  []byte
+	policy  RetryPolicy
+	timeout time.Duration // for each request
+	client  *http.Client
+}
+
+func (w *webhookBackend) Initialize(config GlobalConfig) error {
+	if config.Webhook_url == "" {
+		return errors.New("webhook_url is not set")
+	}
+	w.url = config.Webhook_url
+	w.secret = []byte(config.Webhook_secret)
+	w.policy = config.RetryPolicy("webhook")
+	timeout := config.Webhook_timeout
+	if timeout == 0 {
+		timeout = 30
+	}
+	w.timeout = time.Duration(timeout) * time.Second
+	w.client = &http.Client{}
+	return nil
+}
+
+// Process posts the message, returns its queue id
+func (w *webhookBackend) Process(e *Envelope) (string, error) {
+	env := webhookEnvelope{
+		Helo:          e.Helo,
+		RemoteAddress: e.RemoteAddress,
+		TLS:           e.TLS,
+		MailFrom:      e.MailFrom,
+		Recipients:    e.RcptTo,
+		Hash:          envelopeID(e),
+		Subject:       mimeHeaderDecode(e.Subject),
+		ServerName:    e.ServerName,
+		Parsed:        e.Parsed,
+	}
+	meta, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+	// like RetryPolicy.Do, but a rejection is not tried again
+	for attempt := 1; ; attempt++ {
+		err = w.post(e, meta)
+		if err == nil || isPermanent(err) || attempt >= w.policy.Max_attempts {
+			break
+		}
+		delay := w.policy.Delay(attempt)
+		if !e.Deadline.IsZero() && time.Now().Add(delay).After(e.Deadline) {
+			// no time left for another attempt
+			break
+		}
+		time.Sleep(delay)
+	}
+	if err != nil {
+		return "", err
+	}
+	return env.Hash, nil
+}
+
+// post makes one request, the response is mapped to an SMTPError
+func (w *webhookBackend) post(e *Envelope, meta []byte) error {
+	boundary := newWebhookBoundary()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	// a first pass for the length and the signature, so the body can be streamed
+	sum := hmac.New(sha256.New, w.secret)
+	sum.Write([]byte(timestamp + "."))
+	length := &countingWriter{}
+	if err := writeWebhookBody(io.MultiWriter(sum, length), e, meta, boundary); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(w.timeout)
+	if !e.Deadline.IsZero() && e.Deadline.Before(deadline) {
+		deadline = e.Deadline
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeWebhookBody(pw, e, meta, boundary))
+	}()
+	req, err := http.NewRequest("POST", w.url, pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = length.n
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+	req.Header.Set("User-Agent", "go-guerrilla")
+	if len(w.secret) > 0 {
+		req.Header.Set("X-Guerrilla-Timestamp", timestamp)
+		req.Header.Set("X-Guerrilla-Signature", "sha256="+hex.EncodeToString(sum.Sum(nil)))
+	}
+	resp, err := w.client.Do(req)
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return &SMTPError{554, "5.6.0 Error: rejected by the webhook, " + resp.Status}
+	}
+	return &SMTPError{451, "4.3.0 Error: webhook failed, " + resp.Status + ", try again later"}
+}
+
+// writeWebhookBody writes the multipart body of the request
+func writeWebhookBody(out io.Writer, e *Envelope, meta []byte, boundary string) error {
+	mw := multipart.NewWriter(out)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return err
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="envelope"`)
+	h.Set("Content-Type", "application/json")
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(meta); err != nil {
+		return err
+	}
+	h = make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="message"; filename="message.eml"`)
+	h.Set("Content-Type", "message/rfc822")
+	if part, err = mw.CreatePart(h); err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, e.NewReader()); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// newWebhookBoundary is a random multipart boundary, the same for both passes of a request
+func newWebhookBoundary() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return fmt.Sprintf("guerrilla-%d", time.Now().UnixNano())
+	}
+	return "guerrilla-" + hex.EncodeToString(buf[:])
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+func (w *webhookBackend) Shutdown() error {
+	return nil
+}
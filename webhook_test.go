@@ -0,0 +1,151 @@
+package guerrilla
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookHook is a webhook answering with status, keeping what it was sent
+type webhookHook struct {
+	t        *testing.T
+	secret   string
+	mu       sync.Mutex
+	status   int
+	delay    time.Duration // before answering
+	requests int
+	envelope webhookEnvelope
+	message  string
+}
+
+func (h *webhookHook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.requests++
+	status, delay := h.status, h.delay
+	h.mu.Unlock()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		h.t.Error(err)
+		return
+	}
+	if r.ContentLength != int64(len(body)) {
+		h.t.Errorf("Content-Length %d, got %d bytes", r.ContentLength, len(body))
+	}
+	mac := hmac.New(sha256.New, []byte(h.secret))
+	mac.Write([]byte(r.Header.Get("X-Guerrilla-Timestamp") + "."))
+	mac.Write(body)
+	if got, want := r.Header.Get("X-Guerrilla-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		h.t.Errorf("signature %q, want %q", got, want)
+	}
+	r.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		h.t.Error(err)
+		return
+	}
+	f, _, err := r.FormFile("message")
+	if err != nil {
+		h.t.Error(err)
+		return
+	}
+	message, _ := ioutil.ReadAll(f)
+	h.mu.Lock()
+	json.Unmarshal([]byte(r.FormValue("envelope")), &h.envelope)
+	h.message = string(message)
+	h.mu.Unlock()
+	time.Sleep(delay)
+	w.WriteHeader(status)
+}
+
+// received returns the number of requests, the envelope and the message of the last one
+func (h *webhookHook) received() (int, webhookEnvelope, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requests, h.envelope, h.message
+}
+
+// startWebhook serves h and returns a webhook backend posting to it
+func startWebhook(t *testing.T, h *webhookHook) Backend {
+	h.t = t
+	h.secret = "s3cret"
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	b, err := NewBackend(GlobalConfig{
+		Backend_name:   "webhook",
+		Webhook_url:    srv.URL,
+		Webhook_secret: h.secret,
+		Retry:          map[string]RetryPolicy{"webhook": {Max_attempts: 3, Backoff: 1, Max_backoff: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestWebhookSaved(t *testing.T) {
+	h := &webhookHook{status: http.StatusNoContent}
+	b := startWebhook(t, h)
+	e := newTestEnvelope("Subject: hi\r\n\r\nhello\r\n", "alice@example.com")
+	id, err := b.Process(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests, envelope, message := h.received()
+	if id != e.QueueID || envelope.Hash != id {
+		t.Errorf("id %q, hash %q, want %q", id, envelope.Hash, e.QueueID)
+	}
+	if len(envelope.Recipients) != 1 || envelope.Recipients[0] != "alice@example.com" {
+		t.Errorf("recipients %v", envelope.Recipients)
+	}
+	if message != "Subject: hi\r\n\r\nhello\r\n" {
+		t.Errorf("message %q", message)
+	}
+	if requests != 1 {
+		t.Errorf("%d requests", requests)
+	}
+}
+
+func TestWebhookRejected(t *testing.T) {
+	h := &webhookHook{status: http.StatusUnprocessableEntity}
+	b := startWebhook(t, h)
+	_, err := b.Process(newTestEnvelope("Subject: hi\r\n\r\nhello\r\n", "alice@example.com"))
+	if smtpErr, ok := err.(*SMTPError); !ok || smtpErr.Code != 554 {
+		t.Fatalf("got %v, want a 554", err)
+	}
+	if requests, _, _ := h.received(); requests != 1 {
+		t.Errorf("rejected, but tried %d times", requests)
+	}
+}
+
+func TestWebhookFailed(t *testing.T) {
+	h := &webhookHook{status: http.StatusServiceUnavailable}
+	b := startWebhook(t, h)
+	_, err := b.Process(newTestEnvelope("Subject: hi\r\n\r\nhello\r\n", "alice@example.com"))
+	if smtpErr, ok := err.(*SMTPError); !ok || smtpErr.Code != 451 {
+		t.Fatalf("got %v, want a 451", err)
+	}
+	if requests, _, _ := h.received(); requests != 3 {
+		t.Errorf("tried %d times, want 3", requests)
+	}
+}
+
+func TestWebhookDeadline(t *testing.T) {
+	h := &webhookHook{status: http.StatusOK, delay: time.Second}
+	b := startWebhook(t, h)
+	e := newTestEnvelope("Subject: hi\r\n\r\nhello\r\n", "alice@example.com")
+	e.Deadline = time.Now().Add(200 * time.Millisecond)
+	start := time.Now()
+	if _, err := b.Process(e); err == nil {
+		t.Fatal("saved after the deadline")
+	}
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Errorf("returned %v after the deadline", took)
+	}
+}